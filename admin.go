@@ -0,0 +1,134 @@
+package mysql2nsq
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/siddontang/go-log/log"
+)
+
+// NewAdminHandler 返回管理接口
+//
+//	GET  /admin/gtidset  已经提交的GTIDSet
+//	GET  /admin/position position模式下已经提交的binlog位置
+//	GET  /admin/tables   当前的表结构
+//	GET  /admin/status   运行状态
+//	POST /admin/pause    暂停发布
+//	POST /admin/resume   恢复发布
+//	POST /admin/reload   重新读取表结构
+//	POST /admin/snapshot?table=库名.表名  在同步binlog的同时对表做增量快照
+func NewAdminHandler(runner *Runner) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/admin/gtidset", func(w http.ResponseWriter, req *http.Request) {
+		if !allowMethod(w, req, "GET") {
+			return
+		}
+		if runner.storage == nil {
+			http.Error(w, "position模式没有GTIDSet", http.StatusNotFound)
+			return
+		}
+		GTIDSet, err := runner.storage.Read()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(GTIDSet.String()))
+	})
+
+	mux.HandleFunc("/admin/position", func(w http.ResponseWriter, req *http.Request) {
+		if !allowMethod(w, req, "GET") {
+			return
+		}
+		if runner.positions == nil {
+			http.Error(w, "gtid模式没有binlog位置", http.StatusNotFound)
+			return
+		}
+		pos, err := runner.positions.Read()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(FormatPosition(pos)))
+	})
+
+	mux.HandleFunc("/admin/tables", func(w http.ResponseWriter, req *http.Request) {
+		if !allowMethod(w, req, "GET") {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		runner.tmm.Dump(w)
+	})
+
+	mux.HandleFunc("/admin/status", func(w http.ResponseWriter, req *http.Request) {
+		if !allowMethod(w, req, "GET") {
+			return
+		}
+		writeJSON(w, runner.Status())
+	})
+
+	mux.HandleFunc("/admin/pause", func(w http.ResponseWriter, req *http.Request) {
+		if !allowMethod(w, req, "POST") {
+			return
+		}
+		runner.Pause()
+		writeJSON(w, runner.Status())
+	})
+
+	mux.HandleFunc("/admin/resume", func(w http.ResponseWriter, req *http.Request) {
+		if !allowMethod(w, req, "POST") {
+			return
+		}
+		runner.Resume()
+		writeJSON(w, runner.Status())
+	})
+
+	mux.HandleFunc("/admin/reload", func(w http.ResponseWriter, req *http.Request) {
+		if !allowMethod(w, req, "POST") {
+			return
+		}
+		if err := runner.ReloadTables(); err != nil {
+			log.Errorf("重新读取表结构失败: %s\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("重新读取了表结构: %s\n", runner.tmm.AsStr())
+		w.Header().Set("Content-Type", "application/json")
+		runner.tmm.Dump(w)
+	})
+
+	mux.HandleFunc("/admin/snapshot", func(w http.ResponseWriter, req *http.Request) {
+		if !allowMethod(w, req, "POST") {
+			return
+		}
+		ref, err := parseTableRef(req.URL.Query().Get("table"))
+		if err == nil {
+			err = runner.SnapshotTable(ref.Schema, ref.Table)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, runner.incremental.Pending())
+	})
+
+	return mux
+}
+
+func allowMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("write response failed: %s\n", err)
+	}
+}
@@ -0,0 +1,84 @@
+package mysql2nsq
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/stretchr/testify/assert"
+)
+
+func adminRequest(h http.Handler, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestAdminHandler(t *testing.T) {
+	storage := &memStorage{GTIDs: []string{"36c0fcec-5447-11ea-8dc1-0242ac110002:7"}}
+	r := NewRunner(Config{}, newTestTableMetaManager(), storage, &memSink{})
+	h := NewAdminHandler(r)
+
+	w := adminRequest(h, "GET", "/admin/gtidset")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:7", w.Body.String())
+
+	w = adminRequest(h, "GET", "/admin/tables")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var schemas []Schema
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &schemas))
+	assert.Equal(t, "user", schemas[0].Tables[0].Name)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, adminRequest(h, "GET", "/admin/pause").Code)
+
+	w = adminRequest(h, "POST", "/admin/pause")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var status Status
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.True(t, status.Paused)
+
+	adminRequest(h, "POST", "/admin/resume")
+	w = adminRequest(h, "GET", "/admin/status")
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.False(t, status.Paused)
+}
+
+func TestRunnerPause(t *testing.T) {
+	storage := &memStorage{}
+	sink := &memSink{}
+	r := NewRunner(Config{}, newTestTableMetaManager(), storage, sink)
+	r.Pause()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r.connect = func(GTIDSet mysql.GTIDSet) (eventStreamer, error) {
+		ev := rowsEvent("db1", "user", []interface{}{1, "a"})
+		ev.Header.Timestamp = uint32(time.Now().Unix())
+		return &scriptStreamer{
+			events: []*replication.BinlogEvent{gtidEvent(7), ev, xidEvent()},
+			err:    context.Canceled,
+			onEnd:  cancel,
+		}, nil
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+
+	waitFor(t, func() bool { return r.Status().Connected })
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, r.Status().LastEventReadAt)
+
+	r.Resume()
+	assert.Nil(t, <-done)
+	assert.Equal(t, []string{"36c0fcec-5447-11ea-8dc1-0242ac110002:7"}, storage.GTIDs)
+	assert.False(t, r.Status().LastEventTime.IsZero())
+	assert.False(t, r.Status().Connected)
+}
@@ -0,0 +1,173 @@
+package mysql2nsq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/siddontang/go-log/log"
+)
+
+var metricBackfillRows = newCounter("mysql2nsq_backfill_rows_total", "回填发布的行数")
+
+// BackfillOptions 是回填的参数
+type BackfillOptions struct {
+	Schema string
+	Table  string
+	// Where 是SQL的条件，为空时回填整张表
+	Where string
+	// ChunkSize 是每次读取的行数，默认500
+	ChunkSize int
+	// RowsPerSecond 大于0时限制每秒发布的行数
+	RowsPerSecond int
+	// ID 写入Source.Backfill，为空时随机生成
+	ID string
+}
+
+func (o BackfillOptions) chunkSize() int {
+	size := o.ChunkSize
+	if size <= 0 {
+		size = 500
+	}
+	if o.RowsPerSecond > 0 && o.RowsPerSecond < size {
+		size = o.RowsPerSecond
+	}
+	return size
+}
+
+// Backfiller 按主键分块读取表中满足条件的行，以BACKFILL重新发布，用来修复下游的数据
+//
+// 使用和同步binlog相同的编码和topic路由，不读取也不更新同步的位置，可以在同步运行时使用
+type Backfiller struct {
+	runner *Runner
+	db     *sql.DB
+	// reader 读取数据，测试时替换
+	reader chunkReader
+}
+
+// NewBackfiller 返回Backfiller实例，runner提供编码、topic路由和发布，db用来读取数据
+func NewBackfiller(runner *Runner, db *sql.DB) *Backfiller {
+	return &Backfiller{
+		runner: runner,
+		db:     db,
+		reader: &sqlIncrementalConn{db: db},
+	}
+}
+
+// Count 返回满足条件的行数，不发布
+func (b *Backfiller) Count(ctx context.Context, options BackfillOptions) (int64, error) {
+	if _, err := b.table(options); err != nil {
+		return 0, err
+	}
+
+	var count int64
+	err := b.db.QueryRowContext(ctx, countQuery(options.Schema, options.Table, options.Where)).Scan(&count)
+	return count, err
+}
+
+// Run 回填满足条件的行，返回发布的行数
+// ctx被取消时返回已经发布的行数和ctx的错误
+func (b *Backfiller) Run(ctx context.Context, options BackfillOptions) (int, error) {
+	table, err := b.table(options)
+	if err != nil {
+		return 0, err
+	}
+	if err = b.runner.buildRouter(); err != nil {
+		return 0, err
+	}
+
+	id := options.ID
+	if id == "" {
+		id = uuid.Must(uuid.NewV4()).String()
+	}
+	log.Infof("开始回填%s.%s，标识%s\n", options.Schema, options.Table, id)
+
+	var (
+		lastKey   []interface{}
+		published int
+		started   = time.Now()
+		limit     = options.chunkSize()
+	)
+	for {
+		rows, err := b.reader.readChunk(ctx, options.Schema, table, lastKey, options.Where, limit)
+		if err != nil {
+			return published, err
+		}
+		if len(rows) == 0 {
+			break
+		}
+
+		dc := snapshotDataChanged(options.Schema, table, rows, BACKFILL, time.Now())
+		dc.Source.Backfill = id
+		if err = b.runner.publishData(ctx, dc); err != nil {
+			return published, err
+		}
+		if err = b.runner.retry(ctx, b.runner.sink.Flush); err != nil {
+			return published, err
+		}
+		if ctx.Err() != nil {
+			return published, ctx.Err()
+		}
+		published += len(rows)
+		metricBackfillRows.Add(float64(len(rows)))
+		lastKey = chunkKey(table.PrimaryKey, rows[len(rows)-1])
+		log.Infof("回填%s.%s已发布%d行\n", options.Schema, options.Table, published)
+
+		if len(rows) < limit {
+			break
+		}
+		if err = throttle(ctx, started, published, options.RowsPerSecond); err != nil {
+			return published, err
+		}
+	}
+
+	log.Infof("回填%s.%s完成，共发布%d行\n", options.Schema, options.Table, published)
+	return published, nil
+}
+
+// table 返回要回填的表，表必须有主键
+func (b *Backfiller) table(options BackfillOptions) (*Table, error) {
+	if options.Schema == "" || options.Table == "" {
+		return nil, errors.New("需要指定库名和表名")
+	}
+	table, err := b.runner.tmm.Query(options.Schema, options.Table)
+	if err != nil {
+		return nil, fmt.Errorf("%s.%s: %s", options.Schema, options.Table, err)
+	}
+	if len(table.PrimaryKey) == 0 {
+		return nil, fmt.Errorf("表%s.%s没有主键，不能分块读取", options.Schema, options.Table)
+	}
+	return table, nil
+}
+
+// throttle 等待到按rowsPerSecond发布published行应该用的时间，rowsPerSecond不大于0时不等待
+func throttle(ctx context.Context, started time.Time, published, rowsPerSecond int) error {
+	if rowsPerSecond <= 0 {
+		return nil
+	}
+
+	wait := time.Duration(published)*time.Second/time.Duration(rowsPerSecond) - time.Since(started)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// countQuery 返回统计满足条件的行数的SQL
+func countQuery(schemaName, tableName, where string) string {
+	q := fmt.Sprintf("SELECT COUNT(*) FROM %s.%s", quoteIdent(schemaName), quoteIdent(tableName))
+	if where != "" {
+		q += " WHERE (" + where + ")"
+	}
+	return q
+}
@@ -0,0 +1,80 @@
+package mysql2nsq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBackfiller(conn *fakeSnapshotConn) (*Backfiller, *memSink) {
+	sink := &memSink{}
+	r := NewRunner(Config{Topic: "{schema}.{action}"}, newSnapshotTableMetaManager(), &memStorage{}, sink)
+	b := NewBackfiller(r, nil)
+	b.reader = conn
+	return b, sink
+}
+
+func TestBackfill(t *testing.T) {
+	conn := &fakeSnapshotConn{rows: snapshotRows(5)}
+	b, sink := newTestBackfiller(conn)
+
+	published, err := b.Run(context.Background(), BackfillOptions{Schema: "db1", Table: "user", ChunkSize: 2, ID: "fix-1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, published)
+	assert.Equal(t, [][]interface{}{nil, {int64(2)}, {int64(4)}}, conn.queries)
+
+	assert.Equal(t, 3, len(sink.msgs))
+	var ids []interface{}
+	for _, msg := range sink.msgs {
+		assert.Equal(t, "db1.backfill", msg.Topic)
+		assert.Equal(t, BACKFILL, msg.Data.Action)
+		assert.Equal(t, "fix-1", msg.Data.Source.Backfill)
+		for _, c := range msg.Data.Changes {
+			assert.Nil(t, c.Before)
+			ids = append(ids, c.After["id"])
+		}
+	}
+	assert.Equal(t, []interface{}{int64(1), int64(2), int64(3), int64(4), int64(5)}, ids)
+
+	// 没有指定标识时随机生成
+	_, err = b.Run(context.Background(), BackfillOptions{Schema: "db1", Table: "user"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", sink.msgs[len(sink.msgs)-1].Data.Source.Backfill)
+
+	_, err = b.Run(context.Background(), BackfillOptions{Schema: "db1", Table: "nothing"})
+	assert.NotNil(t, err)
+	_, err = b.Run(context.Background(), BackfillOptions{Table: "user"})
+	assert.NotNil(t, err)
+}
+
+func TestBackfillRateLimit(t *testing.T) {
+	conn := &fakeSnapshotConn{rows: snapshotRows(4)}
+	b, sink := newTestBackfiller(conn)
+
+	// 每秒20行时每块最多20行，4行分成两块各2行需要等待0.1秒
+	options := BackfillOptions{Schema: "db1", Table: "user", ChunkSize: 2, RowsPerSecond: 20}
+	assert.Equal(t, 2, options.chunkSize())
+	assert.Equal(t, 20, BackfillOptions{RowsPerSecond: 20}.chunkSize())
+	assert.Equal(t, 500, BackfillOptions{}.chunkSize())
+
+	started := time.Now()
+	published, err := b.Run(context.Background(), options)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, published)
+	assert.Equal(t, 2, len(sink.msgs))
+	assert.True(t, time.Since(started) >= 100*time.Millisecond)
+
+	// ctx被取消时停止等待
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, throttle(ctx, time.Now(), 100, 1))
+	assert.Nil(t, throttle(ctx, time.Now(), 100, 0))
+}
+
+func TestCountQuery(t *testing.T) {
+	assert.Equal(t, "SELECT COUNT(*) FROM `db1`.`user`", countQuery("db1", "user", ""))
+	assert.Equal(t, "SELECT COUNT(*) FROM `db1`.`user` WHERE (updated_at > '2026-10-01')",
+		countQuery("db1", "user", "updated_at > '2026-10-01'"))
+}
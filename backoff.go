@@ -0,0 +1,77 @@
+package mysql2nsq
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	backoffRandLock sync.Mutex
+	backoffRand     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Backoff 按RetryConfig计算每次重试前的等待时间
+type Backoff struct {
+	config   RetryConfig
+	attempts int
+	interval time.Duration
+}
+
+// NewBackoff 返回Backoff实例，config中没有配置的项使用默认值
+func NewBackoff(config RetryConfig) *Backoff {
+	if config.InitialInterval.Duration <= 0 {
+		config.InitialInterval.Duration = 100 * time.Millisecond
+	}
+	if config.MaxInterval.Duration <= 0 {
+		config.MaxInterval.Duration = 30 * time.Second
+	}
+	if config.Multiplier < 1 {
+		config.Multiplier = 2
+	}
+	if config.Jitter < 0 || config.Jitter > 1 {
+		config.Jitter = 0
+	}
+
+	return &Backoff{config: config}
+}
+
+// Next 在一次失败后调用，返回下次重试前的等待时间
+// 达到最大尝试次数时返回false
+func (b *Backoff) Next() (time.Duration, bool) {
+	b.attempts++
+	if b.config.MaxAttempts > 0 && b.attempts >= b.config.MaxAttempts {
+		return 0, false
+	}
+
+	if b.interval == 0 {
+		b.interval = b.config.InitialInterval.Duration
+	} else {
+		b.interval = time.Duration(float64(b.interval) * b.config.Multiplier)
+	}
+	if b.interval > b.config.MaxInterval.Duration {
+		b.interval = b.config.MaxInterval.Duration
+	}
+
+	wait := b.interval
+	if b.config.Jitter > 0 {
+		// 在[interval*(1-jitter), interval*(1+jitter)]之间随机
+		backoffRandLock.Lock()
+		r := backoffRand.Float64()
+		backoffRandLock.Unlock()
+		wait = time.Duration(float64(wait) * (1 - b.config.Jitter + 2*b.config.Jitter*r))
+	}
+
+	return wait, true
+}
+
+// Attempts 返回已经失败的次数
+func (b *Backoff) Attempts() int {
+	return b.attempts
+}
+
+// Reset 在成功后调用，重新开始计算
+func (b *Backoff) Reset() {
+	b.attempts = 0
+	b.interval = 0
+}
@@ -0,0 +1,43 @@
+package mysql2nsq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(RetryConfig{
+		MaxAttempts:     4,
+		InitialInterval: Duration{100 * time.Millisecond},
+		MaxInterval:     Duration{300 * time.Millisecond},
+		Multiplier:      2,
+	})
+
+	var waits []time.Duration
+	for {
+		wait, ok := b.Next()
+		if !ok {
+			break
+		}
+		waits = append(waits, wait)
+	}
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}, waits)
+	assert.Equal(t, 4, b.Attempts())
+
+	b.Reset()
+	wait, ok := b.Next()
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, wait)
+}
+
+func TestBackoffInfiniteWithJitter(t *testing.T) {
+	b := NewBackoff(RetryConfig{InitialInterval: Duration{time.Second}, Jitter: 0.5})
+
+	for i := 0; i < 100; i++ {
+		wait, ok := b.Next()
+		assert.True(t, ok)
+		assert.True(t, wait >= 500*time.Millisecond && wait <= 45*time.Second, wait)
+	}
+}
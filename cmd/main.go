@@ -8,15 +8,11 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/gofrs/uuid"
 	"github.com/hiwjd/mysql2nsq"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
-	"github.com/nsqio/go-nsq"
 	"github.com/siddontang/go-log/log"
-	"github.com/siddontang/go-mysql/replication"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -29,6 +25,15 @@ func init() {
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [command]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Commands:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  schema-history export [file]  导出表结构历史，默认输出到stdout\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  schema-history import [file]  用file（默认stdin）中的内容替换表结构历史，需要先停止同步\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  backfill -schema db -table t [-where cond]  重新发布表中满足条件的行，backfill -h查看参数\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Options:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	var config mysql2nsq.Config
@@ -36,6 +41,21 @@ func main() {
 		panic(err.Error())
 	}
 
+	if flag.Arg(0) == "schema-history" {
+		if err := schemaHistoryCommand(config, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "backfill" {
+		if err := backfillCommand(config, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var w log.Handler
 	switch config.Log.Output {
 	case "stdout":
@@ -56,14 +76,7 @@ func main() {
 	log.SetLevelByName(config.Log.Level)
 
 	// 数据库
-	mysqlDSN := fmt.Sprintf(
-		"%s:%s@(%s:%d)/information_schema?charset=utf8&parseTime=True&loc=Local",
-		config.Mysql.User,
-		config.Mysql.Password,
-		config.Mysql.Host,
-		config.Mysql.Port,
-	)
-	db, err := sql.Open("mysql", mysqlDSN)
+	db, err := sql.Open("mysql", mysqlDSN(config))
 	// db, err := gorm.Open("mysql", mysqlDSN)
 	if err != nil {
 		log.Fatalf("打开数据库失败: %s\n", err.Error())
@@ -73,104 +86,255 @@ func main() {
 	defer db.Close()
 
 	// 表字段定义
-	tmm, err := mysql2nsq.NewTableMetaManager(db, config.Schemas)
+	var tmmDB *sql.DB
+	if config.TableMetaSource != "binlog" {
+		tmmDB = db
+	}
+	tmm, err := mysql2nsq.NewTableMetaManager(tmmDB, config.Schemas)
 	if err != nil {
 		log.Fatalf("表结构获取失败: %s\n", err.Error())
 	}
 	log.Printf("获得表结构: %s\n", tmm.AsStr())
 
-	// GTIDSet存储器
-	storage, err := mysql2nsq.NewGTIDSetStorage(config.Storage.FilePath, config.Storage.InitGTIDSet)
+	// 表结构历史
+	history, err := mysql2nsq.NewSchemaHistory(config.Storage.SchemaHistoryFilePath())
+	if err != nil {
+		log.Fatalf("Open schema history failed: %s\n", err)
+	}
+	defer history.Close()
+	tmm.SetSchemaHistory(history)
+
+	// GTIDSet存储器，position模式下记录binlog文件名和位置
+	positionMode, err := config.Storage.PositionMode()
 	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	var storage mysql2nsq.GTIDSetStorage
+	var positions mysql2nsq.PositionStorage
+	if positionMode {
+		if positions, err = mysql2nsq.NewPositionStorage(config.Storage.FilePath, config.Storage.InitPosition); err != nil {
+			log.Fatalf("Create PositionStorage failed: %s\n", err)
+		}
+	} else if storage, err = mysql2nsq.NewGTIDSetStorage(config.Storage.FilePath, config.Storage.InitGTIDSet); err != nil {
 		log.Fatalf("Create GTIDSetStorage failed: %s\n", err)
 	}
 
-	// 读取已经同步过的binlog GTIDSet
-	GTIDSet, err := storage.Read()
+	sink, err := mysql2nsq.NewSink(config)
 	if err != nil {
-		log.Fatalf("Read init GTIDSet failed: %s\n", err)
+		log.Fatalf("Create sink failed: %s\n", err)
+	}
+	if config.Spool.Dir != "" {
+		if sink, err = mysql2nsq.NewSpoolSink(sink, config.Spool, config.Retry); err != nil {
+			log.Fatalf("Open spool failed: %s\n", err)
+		}
+	}
+	defer sink.Close()
+
+	runner := mysql2nsq.NewRunner(config, tmm, storage, sink)
+	if positions != nil {
+		runner.SetPositionStorage(positions)
 	}
 
-	nsqConfig := nsq.NewConfig()
-	producer, err := nsq.NewProducer(config.NsqdAddr, nsqConfig)
+	// 初始快照
+	switch config.Snapshot.Mode {
+	case "", mysql2nsq.SnapshotNever:
+	case mysql2nsq.SnapshotInitial:
+		if tmmDB == nil {
+			log.Fatalf("快照需要从information_schema读取表结构，不能使用table_meta_source = \"binlog\"\n")
+		}
+		if positionMode {
+			log.Fatalf("快照从gtid_executed开始同步binlog，不能使用storage.mode = \"position\"\n")
+		}
+		snapshotter, err := mysql2nsq.NewSnapshotter(db, tmm, config.Snapshot, config.Storage.SnapshotStateFilePath())
+		if err != nil {
+			log.Fatalf("Create snapshotter failed: %s\n", err)
+		}
+		runner.SetSnapshotter(snapshotter)
+	default:
+		log.Fatalf("Unknown snapshot mode: %s\n", config.Snapshot.Mode)
+	}
+	if config.Snapshot.SignalTable != "" {
+		incremental, err := mysql2nsq.NewIncrementalSnapshotter(db, tmm, config.Snapshot)
+		if err != nil {
+			log.Fatalf("Create incremental snapshotter failed: %s\n", err)
+		}
+		runner.SetIncrementalSnapshotter(incremental)
+	}
+
+	if config.HTTP.Addr != "" {
+		server := mysql2nsq.NewServer(config.HTTP)
+		health := mysql2nsq.NewHealthHandler(runner)
+		server.Handle("/healthz", health)
+		server.Handle("/readyz", health)
+		if err := server.Start(); err != nil {
+			log.Fatalf("Start HTTP server failed: %s\n", err)
+		}
+		defer server.Close()
+	}
+	if admin := mysql2nsq.NewAdminServer(config.HTTP, runner); admin != nil {
+		if err := admin.Start(); err != nil {
+			log.Fatalf("Start admin server failed: %s\n", err)
+		}
+		defer admin.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		<-c
+		log.Infof("Receive interrupt signal, prepare to exit\n")
+		cancel()
+	}()
+
+	// SIGHUP 重新读取配置文件
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			config = reloadConfig(config, runner)
+		}
+	}()
+
+	if err := runner.Run(ctx); err != nil {
+		log.Errorf("同步停止: %s\n", err)
+	}
+}
+
+// reloadConfig 重新读取配置文件并应用到runner，返回生效的配置
+// 不能在运行时修改的配置只打印警告
+func reloadConfig(current mysql2nsq.Config, runner *mysql2nsq.Runner) mysql2nsq.Config {
+	log.Infof("Receive SIGHUP, reload config %s\n", configPath)
+
+	var config mysql2nsq.Config
+	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+		log.Errorf("读取配置文件失败，继续使用原来的配置: %s\n", err)
+		return current
+	}
+
+	for _, name := range mysql2nsq.NonLiveChanges(current, config) {
+		log.Warnf("配置项%s不能在运行时修改，重启后才会生效\n", name)
+	}
+
+	if err := runner.Reload(config); err != nil {
+		log.Errorf("应用新的配置失败，继续使用原来的配置: %s\n", err)
+		return current
+	}
+
+	if config.Log.Level != current.Log.Level {
+		log.SetLevelByName(config.Log.Level)
+		log.Infof("日志级别: %s\n", config.Log.Level)
+	}
+
+	return config
+}
+
+func schemaHistoryCommand(config mysql2nsq.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: schema-history export|import [file]")
+	}
+
+	history, err := mysql2nsq.NewSchemaHistory(config.Storage.SchemaHistoryFilePath())
 	if err != nil {
-		log.Fatalf("New nsq producer failed: %s\n", err)
+		return err
+	}
+	defer history.Close()
+
+	switch args[0] {
+	case "export":
+		out := os.Stdout
+		if len(args) > 1 {
+			if out, err = os.Create(args[1]); err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		return history.Export(out)
+	case "import":
+		in := os.Stdin
+		if len(args) > 1 {
+			if in, err = os.Open(args[1]); err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+		return history.Import(in)
+	default:
+		return fmt.Errorf("unknown schema-history command: %s", args[0])
 	}
+}
 
-	// Create a binlog syncer with a unique server id, the server id must be different from other MySQL's.
-	// flavor is mysql or mariadb
-	cfg := replication.BinlogSyncerConfig{
-		ServerID: config.Mysql.ServerID,
-		Flavor:   "mysql",
-		Host:     config.Mysql.Host,
-		Port:     config.Mysql.Port,
-		User:     config.Mysql.User,
-		Password: config.Mysql.Password,
+// mysqlDSN 返回连接information_schema的DSN
+func mysqlDSN(config mysql2nsq.Config) string {
+	return fmt.Sprintf(
+		"%s:%s@(%s:%d)/information_schema?charset=utf8&parseTime=True&loc=Local",
+		config.Mysql.User,
+		config.Mysql.Password,
+		config.Mysql.Host,
+		config.Mysql.Port,
+	)
+}
+
+// backfillCommand 按条件重新发布一张表中的行，使用配置中的sink和topic路由，日志输出到stdout
+func backfillCommand(config mysql2nsq.Config, args []string) error {
+	var options mysql2nsq.BackfillOptions
+	var dryRun bool
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	flags.StringVar(&options.Schema, "schema", "", "库名")
+	flags.StringVar(&options.Table, "table", "", "表名")
+	flags.StringVar(&options.Where, "where", "", "SQL条件，例如 updated_at > '2026-10-01'，为空时回填整张表")
+	flags.IntVar(&options.ChunkSize, "chunk-size", 500, "每次读取的行数")
+	flags.IntVar(&options.RowsPerSecond, "rate", 0, "每秒最多发布的行数，0表示不限制")
+	flags.StringVar(&options.ID, "id", "", "写入消息Source.Backfill的标识，默认随机生成")
+	flags.BoolVar(&dryRun, "dry-run", false, "只统计满足条件的行数，不发布")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if options.Schema == "" || options.Table == "" {
+		return fmt.Errorf("usage: backfill -schema db -table t [-where cond] [-dry-run]")
 	}
-	syncer := replication.NewBinlogSyncer(cfg)
+	log.SetLevelByName(config.Log.Level)
 
-	streamer, err := syncer.StartSyncGTID(GTIDSet)
+	db, err := sql.Open("mysql", mysqlDSN(config))
 	if err != nil {
-		log.Fatalf("Start sync failed: %s\n", err)
+		return err
 	}
+	defer db.Close()
 
-	log.Infof("Start syncing from GTIDSet: %s\n", GTIDSet)
+	// 只需要要回填的表的结构，topic路由仍然使用完整的配置
+	tmm, err := mysql2nsq.NewTableMetaManager(db, []mysql2nsq.SchemaConfig{{Name: options.Schema, Tables: []string{options.Table}}})
+	if err != nil {
+		return fmt.Errorf("表结构获取失败: %s", err)
+	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
-
-loop:
-	for {
-		select {
-		case <-c:
-			log.Infof("Receive interrupt signal, prepare to exit\n")
-			syncer.Close()
-			break loop
-		default:
-			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-			ev, err := streamer.GetEvent(ctx)
-			cancel()
-
-			if err != nil {
-				if err == context.DeadlineExceeded {
-					// 超时了，继续等待
-					continue
-				}
-				log.Errorf("等待binlog时触发错误: %s\n", err.Error())
-				syncer.Close()
-				break loop
-			}
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		cancel()
+	}()
 
-			switch e := ev.Event.(type) {
-			case *replication.GTIDEvent:
-				// 更新GTIDSet
-				u, _ := uuid.FromBytes(e.SID)
-				GTID := fmt.Sprintf("%s:%d", u.String(), e.GNO)
-				if err := storage.Update(GTID); err != nil {
-					log.Errorf("更新GTID失败 %s: %s\n", GTID, err.Error())
-				}
-				break
-			case *replication.RowsEvent:
-				// 发送新增、删除、修改数据到nsq
-				dc, err := mysql2nsq.NewDataChangedFromBinlogEvent(ev, tmm)
-				if err != nil {
-					if err == mysql2nsq.ErrNotFound {
-						log.Debugf("转换DataChanged时没知道表定义")
-					} else {
-						log.Errorf("转换成DataChanged出错了：%s\n", err.Error())
-					}
-				} else {
-					log.Debugf("准备发送数据: %+v\n", dc)
-					if bs, err := dc.Encode(); err == nil {
-						if err = producer.Publish(dc.Schema, bs); err != nil {
-							log.Errorf("发布至nsq失败：%s\n", err)
-						}
-					} else {
-						log.Errorf("序列化DataChanged失败: %s\n", err.Error())
-					}
-				}
-				break
-			}
+	if dryRun {
+		count, err := mysql2nsq.NewBackfiller(mysql2nsq.NewRunner(config, tmm, nil, nil), db).Count(ctx, options)
+		if err != nil {
+			return err
 		}
+		fmt.Printf("%s.%s满足条件的行数: %d\n", options.Schema, options.Table, count)
+		return nil
 	}
+
+	// 不使用spool，避免和正在运行的同步共用spool目录
+	sink, err := mysql2nsq.NewSink(config)
+	if err != nil {
+		return err
+	}
+	defer sink.Close()
+
+	published, err := mysql2nsq.NewBackfiller(mysql2nsq.NewRunner(config, tmm, nil, sink), db).Run(ctx, options)
+	fmt.Printf("%s.%s已发布%d行\n", options.Schema, options.Table, published)
+	return err
 }
@@ -1,13 +1,34 @@
 package mysql2nsq
 
+import (
+	"fmt"
+	"time"
+)
+
 // Config 是配置
 type Config struct {
 	Log         LogConfig            `toml:"log"`
 	Mysql       MysqlConfig          `toml:"mysql"`
 	NsqdAddr    string               `toml:"nsqd_addr"`
+	Nsq         NsqConfig            `toml:"nsq"`
+	Sink        SinkConfig           `toml:"sink"`
+	Retry       RetryConfig          `toml:"retry"`
+	Spool       SpoolConfig          `toml:"spool"`
+	Reconnect   ReconnectConfig      `toml:"reconnect"`
+	HTTP        HTTPConfig           `toml:"http"`
+	Health      HealthConfig         `toml:"health"`
+	Snapshot    SnapshotConfig       `toml:"snapshot"`
 	Schemas     []SchemaConfig       `toml:"schema"`
 	Storage     GTIDSetStorageConfig `toml:"storage"`
 	EnableDBLog bool                 `toml:"enable_db_log"`
+	// 表结构的来源：
+	// information_schema（默认）启动时从information_schema读取，TableMapEvent带有字段名时优先使用TableMapEvent
+	// binlog 只使用TableMapEvent中的元数据，需要mysql开启binlog_row_metadata=FULL，不需要information_schema的权限
+	TableMetaSource string `toml:"table_meta_source"`
+	// 消息格式：rows（默认）和以前的版本兼容，所有镜像放在一个Rows列表中；changes 每行带有Before和After
+	MessageFormat MessageFormat `toml:"message_format"`
+	// Topic 是消息的topic模板，可以使用{schema}、{table}、{action}，默认是{schema}
+	Topic string `toml:"topic"`
 }
 
 // LogConfig 是日志配置
@@ -33,10 +54,250 @@ type MysqlConfig struct {
 type SchemaConfig struct {
 	Name   string   `toml:"name"`
 	Tables []string `toml:"tables"`
+	// Topic 是该库的消息的topic模板，为空时使用Config.Topic
+	Topic string `toml:"topic"`
+	// TableConfigs 是单独配置的表，key是表名
+	TableConfigs map[string]TableConfig `toml:"table"`
+}
+
+// TableConfig 是单张表的配置
+type TableConfig struct {
+	// Topic 是该表的消息的topic模板，为空时使用库的配置
+	Topic string `toml:"topic"`
+	// Shards 大于0时按ShardKey的hash把行分到Shards个topic，topic是模板展开后加上`.0`到`.Shards-1`
+	Shards int `toml:"shards"`
+	// ShardKey 是计算分片的字段，为空时使用主键
+	ShardKey string `toml:"shard_key"`
+	// RouteColumn 不为空时用该字段的值在TopicMap中查找topic模板，找不到时使用DefaultTopic
+	RouteColumn string `toml:"route_column"`
+	// TopicMap 是RouteColumn的值到topic模板的映射
+	TopicMap map[string]string `toml:"topic_map"`
+	// DefaultTopic 是RouteColumn的值不在TopicMap中时的topic模板，为空时使用Topic
+	DefaultTopic string `toml:"default_topic"`
 }
 
+// includes 返回该库的配置是否包含表tableName，表名列表留空表示包含所有表
+func (sc SchemaConfig) includes(tableName string) bool {
+	if len(sc.Tables) == 0 {
+		return true
+	}
+	for _, name := range sc.Tables {
+		if name == tableName {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// StorageModeGTID 记录GTIDSet，用StartSyncGTID同步（默认）
+	StorageModeGTID = "gtid"
+	// StorageModePosition 记录binlog文件名和位置，用StartSync同步，用于没有开启GTID的mysql
+	StorageModePosition = "position"
+)
+
 // GTIDSetStorageConfig 是记录GTIDSet的Storage的配置
 type GTIDSetStorageConfig struct {
+	// 记录同步位置的方式：gtid（默认）或者position
+	Mode        string `toml:"mode"`
 	FilePath    string `toml:"file_path"`
 	InitGTIDSet string `toml:"init_gtidset"`
+	// position模式的初始位置，格式是"文件名:位置"，为空时从最早的binlog开始
+	InitPosition string `toml:"init_position"`
+	// 表结构历史文件路径，默认是FilePath加上`.schema_history`后缀
+	SchemaHistoryPath string `toml:"schema_history_path"`
+	// 快照进度文件路径，默认是FilePath加上`.snapshot`后缀
+	SnapshotStatePath string `toml:"snapshot_state_path"`
+}
+
+// PositionMode 返回是否使用binlog文件名和位置记录同步位置
+func (c GTIDSetStorageConfig) PositionMode() (bool, error) {
+	switch c.Mode {
+	case "", StorageModeGTID:
+		return false, nil
+	case StorageModePosition:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown storage mode: %s", c.Mode)
+	}
+}
+
+// SchemaHistoryFilePath 返回表结构历史文件路径
+func (c GTIDSetStorageConfig) SchemaHistoryFilePath() string {
+	if c.SchemaHistoryPath != "" {
+		return c.SchemaHistoryPath
+	}
+	return c.FilePath + ".schema_history"
+}
+
+// SnapshotStateFilePath 返回快照进度文件路径
+func (c GTIDSetStorageConfig) SnapshotStateFilePath() string {
+	if c.SnapshotStatePath != "" {
+		return c.SnapshotStatePath
+	}
+	return c.FilePath + ".snapshot"
+}
+
+// SinkConfig 是投递目标的配置
+type SinkConfig struct {
+	Type    string            `toml:"type"`    // 通过RegisterSink注册的类型，默认nsq
+	Options map[string]string `toml:"options"` // 自定义Sink的参数
+}
+
+// HTTPConfig 是HTTP服务的配置，Addr为空时不启动
+type HTTPConfig struct {
+	Addr string `toml:"addr"` // 监听地址，比如 127.0.0.1:9200
+	// AdminAddr 是管理接口的监听地址，和/metrics分开，为空时不启动管理接口
+	// 管理接口没有认证，应该只监听本机地址，比如 127.0.0.1:9201
+	AdminAddr string `toml:"admin_addr"`
+}
+
+// HealthConfig 是健康检查的配置
+type HealthConfig struct {
+	// HeartbeatPeriod 是mysql在没有新事件时发送心跳的间隔，0表示不发送
+	HeartbeatPeriod Duration `toml:"heartbeat_period"`
+	// StreamTimeout 是多久没有收到事件或心跳时重新连接，默认是HeartbeatPeriod的3倍，没有心跳时不检查
+	StreamTimeout Duration `toml:"stream_timeout"`
+	// LivenessTimeout 是同步的循环多久没有进展时认为卡住了，默认1m
+	LivenessTimeout Duration `toml:"liveness_timeout"`
+}
+
+func (c HealthConfig) streamTimeout() time.Duration {
+	if c.StreamTimeout.Duration > 0 {
+		return c.StreamTimeout.Duration
+	}
+	return 3 * c.HeartbeatPeriod.Duration
+}
+
+func (c HealthConfig) livenessTimeout() time.Duration {
+	if c.LivenessTimeout.Duration > 0 {
+		return c.LivenessTimeout.Duration
+	}
+	return time.Minute
+}
+
+// NsqConfig 是nsq的配置
+// 可以同时配置nsqd和nsqlookupd，NsqdAddr也会被使用
+type NsqConfig struct {
+	NsqdAddrs         []string `toml:"nsqd_addrs"`
+	LookupdHTTPAddrs  []string `toml:"nsqlookupd_http_addrs"`
+	DiscoveryInterval Duration `toml:"discovery_interval"` // 多久重新查询一次nsqlookupd并检查失败的nsqd，默认30s
+	Strategy          string   `toml:"strategy"`           // sticky（默认）或者 round_robin
+}
+
+// RetryConfig 是发布失败时重试的配置
+// 重试期间不再读取binlog，也不会更新GTIDSet
+type RetryConfig struct {
+	MaxAttempts     int      `toml:"max_attempts"`     // 最多尝试几次（包括第一次），0表示一直重试
+	InitialInterval Duration `toml:"initial_interval"` // 第一次重试前的等待时间，默认100ms
+	MaxInterval     Duration `toml:"max_interval"`     // 最长等待时间，默认30s
+	Multiplier      float64  `toml:"multiplier"`       // 每次重试后等待时间乘以该值，默认2
+	Jitter          float64  `toml:"jitter"`           // 0~1，等待时间随机上下浮动的比例
+}
+
+// ReconnectConfig 是binlog连接断开后重连的配置
+type ReconnectConfig struct {
+	MaxAttempts     int      `toml:"max_attempts"`     // 连续重连几次都失败后放弃，0表示一直重连
+	GiveUpAfter     Duration `toml:"give_up_after"`    // 连续断开多久后放弃，0表示不限制
+	InitialInterval Duration `toml:"initial_interval"` // 第一次重连前的等待时间，默认100ms
+	MaxInterval     Duration `toml:"max_interval"`     // 最长等待时间，默认30s
+	Multiplier      float64  `toml:"multiplier"`       // 每次重连后等待时间乘以该值，默认2
+	Jitter          float64  `toml:"jitter"`           // 0~1，等待时间随机上下浮动的比例
+}
+
+func (c ReconnectConfig) backoffConfig() RetryConfig {
+	config := RetryConfig{
+		InitialInterval: c.InitialInterval,
+		MaxInterval:     c.MaxInterval,
+		Multiplier:      c.Multiplier,
+		Jitter:          c.Jitter,
+	}
+	if c.MaxAttempts > 0 {
+		// 第一次断开不算重连
+		config.MaxAttempts = c.MaxAttempts + 1
+	}
+	return config
+}
+
+// SpoolConfig 是本地spool的配置，Dir为空时不使用spool
+type SpoolConfig struct {
+	Dir         string   `toml:"dir"`
+	SegmentSize int64    `toml:"segment_size"` // 每个段文件的大小，MB，默认64
+	MaxSize     int64    `toml:"max_size"`     // 最多保存多少MB未投递的数据，0表示不限制
+	MaxAge      Duration `toml:"max_age"`      // 最旧的未投递数据最多保存多久，0表示不限制
+}
+
+func (c SpoolConfig) segmentSize() int64 {
+	if c.SegmentSize <= 0 {
+		return 64 * 1024 * 1024
+	}
+	return c.SegmentSize * 1024 * 1024
+}
+
+// Duration 是可以用"500ms"、"1m"这样的字符串配置的时间间隔
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText implement encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+const (
+	// SnapshotNever 不做快照，只同步binlog（默认）
+	SnapshotNever = "never"
+	// SnapshotInitial 第一次启动时先做快照，再从快照时的GTIDSet开始同步binlog
+	SnapshotInitial = "initial"
+)
+
+// SnapshotConfig 是初始快照的配置
+type SnapshotConfig struct {
+	// Mode 是never或者initial
+	Mode string `toml:"mode"`
+	// ChunkSize 是每次读取的行数，每块数据作为一条消息发布，默认500
+	ChunkSize int `toml:"chunk_size"`
+	// Lock 为true时用FLUSH TABLES WITH READ LOCK短暂锁住所有表，使记录的gtid_executed和快照完全一致，需要RELOAD权限
+	// 为false时先读gtid_executed再开始快照，之间提交的事务会在快照和binlog中各出现一次
+	Lock bool `toml:"lock"`
+	// SignalTable 是增量快照用来写入水位和接收请求的表，格式是"库名.表名"，为空时不能做增量快照
+	SignalTable string `toml:"signal_table"`
+}
+
+func (c SnapshotConfig) chunkSize() int {
+	if c.ChunkSize > 0 {
+		return c.ChunkSize
+	}
+	return 500
+}
+
+// NonLiveChanges 返回从old到new改变了、但是不能在运行时修改的配置项，修改这些配置需要重启
+func NonLiveChanges(old, new Config) []string {
+	var changes []string
+	check := func(name string, changed bool) {
+		if changed {
+			changes = append(changes, name)
+		}
+	}
+
+	check("mysql.host", old.Mysql.Host != new.Mysql.Host)
+	check("mysql.port", old.Mysql.Port != new.Mysql.Port)
+	check("mysql.user", old.Mysql.User != new.Mysql.User)
+	check("mysql.password", old.Mysql.Password != new.Mysql.Password)
+	check("mysql.server_id", old.Mysql.ServerID != new.Mysql.ServerID)
+	check("storage", old.Storage != new.Storage)
+	check("table_meta_source", old.TableMetaSource != new.TableMetaSource)
+	check("sink.type", old.Sink.Type != new.Sink.Type)
+	check("spool", old.Spool != new.Spool)
+	check("http.addr", old.HTTP.Addr != new.HTTP.Addr)
+	check("http.admin_addr", old.HTTP.AdminAddr != new.HTTP.AdminAddr)
+	check("health.heartbeat_period", old.Health.HeartbeatPeriod != new.Health.HeartbeatPeriod)
+	check("nsq.discovery_interval", old.Nsq.DiscoveryInterval != new.Nsq.DiscoveryInterval)
+	check("snapshot", old.Snapshot != new.Snapshot)
+	oldLog, newLog := old.Log, new.Log
+	oldLog.Level, newLog.Level = "", ""
+	check("log（level除外）", oldLog != newLog)
+
+	return changes
 }
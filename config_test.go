@@ -2,6 +2,7 @@ package mysql2nsq
 
 import (
 	"testing"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/stretchr/testify/assert"
@@ -31,6 +32,14 @@ nsqd_addr = "127.0.0.1:4150"
   name = "schema2"
   tables = ["table1", "table3"]
 
+[sink]
+  type = "nsq"
+
+[retry]
+  max_attempts = 5
+  initial_interval = "200ms"
+  max_interval = "1m"
+
 [storage]
   file_path = "./gtidset.db"
   init_gtidset = "36c0fcec-5447-11ea-8dc1-0242ac110002:1-7713"
@@ -50,6 +59,10 @@ nsqd_addr = "127.0.0.1:4150"
 	assert.Equal(t, "", config.Mysql.Password)
 
 	assert.Equal(t, "127.0.0.1:4150", config.NsqdAddr)
+	assert.Equal(t, "nsq", config.Sink.Type)
+	assert.Equal(t, 5, config.Retry.MaxAttempts)
+	assert.Equal(t, 200*time.Millisecond, config.Retry.InitialInterval.Duration)
+	assert.Equal(t, time.Minute, config.Retry.MaxInterval.Duration)
 
 	assert.Equal(t, 2, len(config.Schemas))
 
@@ -64,4 +77,43 @@ nsqd_addr = "127.0.0.1:4150"
 
 	assert.Equal(t, "./gtidset.db", config.Storage.FilePath)
 	assert.Equal(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-7713", config.Storage.InitGTIDSet)
+
+	positionMode, err := config.Storage.PositionMode()
+	assert.Nil(t, err)
+	assert.False(t, positionMode)
+}
+
+func TestStoragePositionMode(t *testing.T) {
+	var config Config
+	_, err := toml.Decode(`
+[storage]
+  mode = "position"
+  file_path = "./position.db"
+  init_position = "mysql-bin.000003:4"
+`, &config)
+	assert.Nil(t, err)
+	assert.Equal(t, "mysql-bin.000003:4", config.Storage.InitPosition)
+	positionMode, err := config.Storage.PositionMode()
+	assert.Nil(t, err)
+	assert.True(t, positionMode)
+
+	_, err = GTIDSetStorageConfig{Mode: "binlog"}.PositionMode()
+	assert.NotNil(t, err)
+}
+
+func TestNonLiveChanges(t *testing.T) {
+	old := Config{
+		Log:     LogConfig{Output: "stdout", Level: "info"},
+		Mysql:   MysqlConfig{ServerID: 102, Host: "127.0.0.1"},
+		Schemas: []SchemaConfig{{Name: "schema1"}},
+	}
+
+	new := old
+	new.Log.Level = "debug"
+	new.Schemas = []SchemaConfig{{Name: "schema2"}}
+	assert.Empty(t, NonLiveChanges(old, new))
+
+	new.Mysql.Host = "10.0.0.1"
+	new.Mysql.ServerID = 103
+	assert.Equal(t, []string{"mysql.host", "mysql.server_id"}, NonLiveChanges(old, new))
 }
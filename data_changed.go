@@ -3,6 +3,9 @@ package mysql2nsq
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"reflect"
+	"time"
 
 	"github.com/siddontang/go-log/log"
 	"github.com/siddontang/go-mysql/replication"
@@ -23,26 +26,157 @@ var (
 	UPDATE Action = "UPDATE"
 	// DELETE delete
 	DELETE Action = "DELETE"
+	// READ 初始快照读出的行，只有After
+	READ Action = "READ"
+	// BACKFILL 回填命令读出的行，只有After
+	BACKFILL Action = "BACKFILL"
 )
 
+// RowImage 是binlog中行镜像的类型，对应mysql的binlog_row_image
+type RowImage string
+
+var (
+	// FULL 每行都带有所有字段
+	FULL RowImage = "FULL"
+	// NOBLOB 除了没有变化的BLOB/TEXT字段，带有所有字段
+	NOBLOB RowImage = "NOBLOB"
+	// MINIMAL 只带有定位行需要的字段和变化了的字段
+	MINIMAL RowImage = "MINIMAL"
+)
+
+// MessageFormat 是DataChanged的编码格式
+type MessageFormat string
+
+var (
+	// FormatChanges 每行一个RowChange，UPDATE带有Before和After，需要配置后才使用
+	FormatChanges MessageFormat = "changes"
+	// FormatRows 默认的格式，和以前的版本兼容，所有镜像放在一个Rows列表中，UPDATE是[前镜像, 后镜像, ...]交替排列
+	FormatRows MessageFormat = "rows"
+)
+
+// RowChange 是一行数据的变化
+type RowChange struct {
+	// Before 是变化前的镜像，只有UPDATE和DELETE有
+	Before map[string]interface{} `json:",omitempty"`
+	// After 是变化后的镜像，只有INSERT和UPDATE有
+	After map[string]interface{} `json:",omitempty"`
+	// Changed 是UPDATE中值变化了的字段，按字段顺序排列
+	Changed []string `json:",omitempty"`
+	// BeforeAbsent 和 AfterAbsent 是镜像中没有的字段，以此和值为NULL的字段区分
+	BeforeAbsent []string `json:",omitempty"`
+	AfterAbsent  []string `json:",omitempty"`
+	// Key 是该行主键的值，DELETE取自Before，其他取自After，表没有主键时为空
+	// 单个字段的主键是字段值，联合主键是json编码的字段值列表，比如 ["1","a"]
+	Key string `json:",omitempty"`
+	// OldKey 是UPDATE修改了主键时，修改前的主键
+	OldKey string `json:",omitempty"`
+}
+
+// Source 是DataChanged在binlog中的来源，可以用来去重、排序和计算延迟
+type Source struct {
+	// ServerID 是产生该事件的mysql的server_id
+	ServerID uint32
+	// GTID 是事件所在事务的GTID
+	GTID string `json:",omitempty"`
+	// File 和 Pos 是事件在binlog中的文件名和结束位置
+	File string
+	Pos  uint32
+	// Timestamp 是事件在mysql中发生的时间
+	Timestamp time.Time
+	// RowIndex 是第一行在事务中的下标，第i行（UPDATE每对前后镜像算一行）的下标是RowIndex+i
+	// GTID和行的下标可以唯一确定一行变化
+	RowIndex int
+	// RowIndexes 是RowsEvent按topic拆分后每行在事务中的下标，和Changes一一对应，没有拆分时为空
+	RowIndexes []int `json:",omitempty"`
+	// Backfill 是回填命令的标识，只有回填的消息才有
+	Backfill string `json:",omitempty"`
+}
+
 // DataChanged represents binlog RowEvent
 type DataChanged struct {
 	Schema string
 	Table  string
 	Action Action
-	Rows   []map[string]interface{}
+	// PrimaryKey 是表的主键字段，表没有主键时为空
+	PrimaryKey []string `json:",omitempty"`
+	// Changes 是每行的变化，FormatRows格式中为空
+	Changes []RowChange `json:",omitempty"`
+	// Rows 只在FormatRows格式中使用
+	Rows []map[string]interface{} `json:",omitempty"`
+	// RowImage 是根据RowsEvent的字段位图判断出的行镜像类型
+	RowImage RowImage
+	// Absent 只在FormatRows格式中使用，和Rows一一对应，是该行镜像中没有的字段
+	// 所有行都带有全部字段时为nil
+	Absent [][]string `json:",omitempty"`
+	// Keys 只在FormatRows格式中使用，和Rows一一对应，是该行镜像的主键
+	Keys []string `json:",omitempty"`
+	// Source 是数据在binlog中的来源
+	Source Source
+	// PublishedAt 是mysql2nsq最后一次尝试发布该消息的时间，写入spool的消息是写入spool的时间
+	PublishedAt time.Time
 }
 
 func (dc DataChanged) Encode() ([]byte, error) {
 	return json.Marshal(dc)
 }
 
+// EncodeAs 按format编码，format为空时使用FormatRows
+func (dc DataChanged) EncodeAs(format MessageFormat) ([]byte, error) {
+	if format == FormatChanges {
+		return dc.Encode()
+	}
+	return dc.Flatten().Encode()
+}
+
 func (dc *DataChanged) Decode(bs []byte) error {
 	return json.Unmarshal(bs, dc)
 }
 
+// Flatten 返回FormatRows格式的DataChanged，Changes中的镜像按顺序放到Rows中
+func (dc DataChanged) Flatten() DataChanged {
+	if len(dc.Changes) == 0 {
+		return dc
+	}
+
+	var rows []map[string]interface{}
+	var absent [][]string
+	var keys []string
+	hasAbsent := false
+	for _, c := range dc.Changes {
+		if c.Before != nil {
+			key := c.Key
+			if c.OldKey != "" {
+				key = c.OldKey
+			}
+			rows = append(rows, c.Before)
+			absent = append(absent, c.BeforeAbsent)
+			keys = append(keys, key)
+			hasAbsent = hasAbsent || len(c.BeforeAbsent) > 0
+		}
+		if c.After != nil {
+			rows = append(rows, c.After)
+			absent = append(absent, c.AfterAbsent)
+			keys = append(keys, c.Key)
+			hasAbsent = hasAbsent || len(c.AfterAbsent) > 0
+		}
+	}
+
+	dc.Changes = nil
+	dc.Rows = rows
+	dc.Absent = nil
+	if hasAbsent {
+		dc.Absent = absent
+	}
+	dc.Keys = nil
+	if len(dc.PrimaryKey) > 0 {
+		dc.Keys = keys
+	}
+	return dc
+}
+
 // NewDataChangedFromBinlogEvent construct DataChanged from BinlogEvent
-func NewDataChangedFromBinlogEvent(ev *replication.BinlogEvent, tmm *TableMetaManager) (*DataChanged, error) {
+// tmm 可以是*TableMetaManager，或者TableMetaManager.At返回的指定了binlog位置的TableQuerier
+func NewDataChangedFromBinlogEvent(ev *replication.BinlogEvent, tmm TableQuerier) (*DataChanged, error) {
 	dc := &DataChanged{}
 
 	switch ev.Header.EventType {
@@ -75,24 +209,129 @@ func NewDataChangedFromBinlogEvent(ev *replication.BinlogEvent, tmm *TableMetaMa
 		return nil, err
 	}
 
-	rows := make([]map[string]interface{}, len(evt.Rows))
+	dc.RowImage = FULL
+	dc.PrimaryKey = tbl.PrimaryKey
 
+	var change RowChange
 	for i, row := range evt.Rows {
 		r := make(map[string]interface{})
+		var absent []string
+
+		// UPDATE的每行是前后两个镜像，前镜像使用ColumnBitmap1，后镜像使用ColumnBitmap2
+		bitmap := evt.ColumnBitmap1
+		if dc.Action == UPDATE && i%2 == 1 {
+			bitmap = evt.ColumnBitmap2
+		}
 
+		image := FULL
 		for j, v := range row {
 			col, err := tbl.Query(j)
 			if err != nil {
 				return nil, err
 			}
 
+			if bitmap != nil && !isBitSet(bitmap, j) {
+				// 镜像中没有该字段，和NULL区分开
+				absent = append(absent, col.ColumnName)
+				if image == FULL && isBlobType(col.DataType) {
+					image = NOBLOB
+				} else if !isBlobType(col.DataType) {
+					image = MINIMAL
+				}
+				continue
+			}
+
 			r[col.ColumnName] = col.Format(v)
 		}
 
-		rows[i] = r
-	}
+		if image == MINIMAL || (image == NOBLOB && dc.RowImage == FULL) {
+			dc.RowImage = image
+		}
 
-	dc.Rows = rows
+		switch {
+		case dc.Action == INSERT:
+			dc.Changes = append(dc.Changes, RowChange{After: r, AfterAbsent: absent, Key: RowKey(tbl.PrimaryKey, r, nil)})
+		case dc.Action == DELETE:
+			dc.Changes = append(dc.Changes, RowChange{Before: r, BeforeAbsent: absent, Key: RowKey(tbl.PrimaryKey, r, nil)})
+		case i%2 == 0:
+			change = RowChange{Before: r, BeforeAbsent: absent}
+		default:
+			change.After, change.AfterAbsent = r, absent
+			change.Changed = changedColumns(tbl, change.Before, change.After)
+			// MINIMAL的后镜像中没有未修改的主键字段，从前镜像中取
+			change.Key = RowKey(tbl.PrimaryKey, change.After, change.Before)
+			if oldKey := RowKey(tbl.PrimaryKey, change.Before, nil); oldKey != change.Key {
+				change.OldKey = oldKey
+			}
+			dc.Changes = append(dc.Changes, change)
+		}
+	}
 
 	return dc, nil
 }
+
+// RowKey 返回行的主键值，row中没有的主键字段从fallback中取
+// 单个字段的主键返回字段值，联合主键返回json编码的字段值列表
+// 没有主键或者主键字段不全时返回空字符串
+func RowKey(primaryKey []string, row, fallback map[string]interface{}) string {
+	if len(primaryKey) == 0 {
+		return ""
+	}
+
+	values := make([]string, 0, len(primaryKey))
+	for _, name := range primaryKey {
+		v, ok := row[name]
+		if !ok {
+			if v, ok = fallback[name]; !ok {
+				return ""
+			}
+		}
+		values = append(values, keyValue(v))
+	}
+
+	if len(values) == 1 {
+		return values[0]
+	}
+
+	bs, _ := json.Marshal(values)
+	return string(bs)
+}
+
+func keyValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(x)
+	case string:
+		return x
+	case time.Time:
+		return x.Format("2006-01-02 15:04:05.999999")
+	}
+	return fmt.Sprint(v)
+}
+
+// changedColumns 返回after中和before不同的字段，before中没有的字段也算作变化了
+func changedColumns(tbl *Table, before, after map[string]interface{}) []string {
+	var changed []string
+	for _, col := range tbl.Columns {
+		v, ok := after[col.ColumnName]
+		if !ok {
+			continue
+		}
+		if old, ok := before[col.ColumnName]; ok && reflect.DeepEqual(old, v) {
+			continue
+		}
+		changed = append(changed, col.ColumnName)
+	}
+	return changed
+}
+
+// isBlobType 返回字段是否是binlog_row_image=NOBLOB时可以省略的类型
+func isBlobType(dataType string) bool {
+	switch dataType {
+	case "tinyblob", "blob", "mediumblob", "longblob", "tinytext", "text", "mediumtext", "longtext", "json", "geometry":
+		return true
+	}
+	return false
+}
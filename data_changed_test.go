@@ -3,6 +3,7 @@ package mysql2nsq
 import (
 	"testing"
 
+	"github.com/siddontang/go-mysql/replication"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -45,3 +46,179 @@ func TestEncodeDecode(t *testing.T) {
 		// }
 	}
 }
+
+func testUserTables() TableQuerier {
+	return &TableMetaManager{
+		schemaConfigs: []SchemaConfig{{Name: "db1"}},
+		schemas: []Schema{{
+			Name: "db1",
+			Tables: []Table{{
+				Name: "user",
+				Columns: []Column{
+					{ColumnName: "id", OrdinalPosition: 1, IsNullable: "NO", DataType: "int"},
+					{ColumnName: "name", OrdinalPosition: 2, IsNullable: "YES", DataType: "varchar"},
+					{ColumnName: "bio", OrdinalPosition: 3, IsNullable: "YES", DataType: "text"},
+				},
+			}},
+		}},
+	}
+}
+
+func updateRowsEvent(bitmap1, bitmap2 byte, rows ...[]interface{}) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.UPDATE_ROWS_EVENTv2},
+		Event: &replication.RowsEvent{
+			Table:         &replication.TableMapEvent{Schema: []byte("db1"), Table: []byte("user")},
+			ColumnCount:   3,
+			ColumnBitmap1: []byte{bitmap1},
+			ColumnBitmap2: []byte{bitmap2},
+			Rows:          rows,
+		},
+	}
+}
+
+func TestRowImageFull(t *testing.T) {
+	ev := updateRowsEvent(0x07, 0x07, []interface{}{1, nil, "a"}, []interface{}{1, "hiwjd", "a"})
+	dc, err := NewDataChangedFromBinlogEvent(ev, testUserTables())
+	assert.Nil(t, err)
+	assert.Equal(t, FULL, dc.RowImage)
+	assert.Equal(t, []RowChange{{
+		Before:  map[string]interface{}{"id": 1, "name": nil, "bio": "a"},
+		After:   map[string]interface{}{"id": 1, "name": "hiwjd", "bio": "a"},
+		Changed: []string{"name"},
+	}}, dc.Changes)
+
+	legacy := dc.Flatten()
+	assert.Nil(t, legacy.Changes)
+	assert.Nil(t, legacy.Absent)
+	assert.Equal(t, []map[string]interface{}{{"id": 1, "name": nil, "bio": "a"}, {"id": 1, "name": "hiwjd", "bio": "a"}}, legacy.Rows)
+}
+
+func TestRowImageMinimal(t *testing.T) {
+	// 前镜像只有主键，后镜像只有变化了的name
+	ev := updateRowsEvent(0x01, 0x02, []interface{}{1, nil, nil}, []interface{}{nil, "hiwjd", nil})
+	dc, err := NewDataChangedFromBinlogEvent(ev, testUserTables())
+	assert.Nil(t, err)
+	assert.Equal(t, MINIMAL, dc.RowImage)
+	assert.Equal(t, []RowChange{{
+		Before:       map[string]interface{}{"id": 1},
+		After:        map[string]interface{}{"name": "hiwjd"},
+		Changed:      []string{"name"},
+		BeforeAbsent: []string{"name", "bio"},
+		AfterAbsent:  []string{"id", "bio"},
+	}}, dc.Changes)
+
+	legacy := dc.Flatten()
+	assert.Equal(t, []map[string]interface{}{{"id": 1}, {"name": "hiwjd"}}, legacy.Rows)
+	assert.Equal(t, [][]string{{"name", "bio"}, {"id", "bio"}}, legacy.Absent)
+}
+
+func TestRowImageNoblob(t *testing.T) {
+	// 没有变化的text字段被省略，name的NULL保留
+	ev := updateRowsEvent(0x03, 0x03, []interface{}{1, "hiwjd", nil}, []interface{}{1, nil, nil})
+	dc, err := NewDataChangedFromBinlogEvent(ev, testUserTables())
+	assert.Nil(t, err)
+	assert.Equal(t, NOBLOB, dc.RowImage)
+	assert.Equal(t, []RowChange{{
+		Before:       map[string]interface{}{"id": 1, "name": "hiwjd"},
+		After:        map[string]interface{}{"id": 1, "name": nil},
+		Changed:      []string{"name"},
+		BeforeAbsent: []string{"bio"},
+		AfterAbsent:  []string{"bio"},
+	}}, dc.Changes)
+
+	// 编码后仍然可以区分
+	bs, err := dc.Encode()
+	assert.Nil(t, err)
+	dc2 := &DataChanged{}
+	assert.Nil(t, dc2.Decode(bs))
+	_, ok := dc2.Changes[0].After["name"]
+	assert.True(t, ok)
+	_, ok = dc2.Changes[0].After["bio"]
+	assert.False(t, ok)
+	assert.Equal(t, NOBLOB, dc2.RowImage)
+}
+
+func TestMultiRowUpdate(t *testing.T) {
+	ev := updateRowsEvent(0x07, 0x07,
+		[]interface{}{1, "a", nil}, []interface{}{1, "b", nil},
+		[]interface{}{2, "c", nil}, []interface{}{2, "c", "bio"},
+	)
+	dc, err := NewDataChangedFromBinlogEvent(ev, testUserTables())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(dc.Changes))
+	assert.Equal(t, 2, dc.Changes[1].Before["id"])
+	assert.Equal(t, []string{"name"}, dc.Changes[0].Changed)
+	assert.Equal(t, []string{"bio"}, dc.Changes[1].Changed)
+
+	bs, err := dc.EncodeAs(FormatRows)
+	assert.Nil(t, err)
+	legacy := &DataChanged{}
+	assert.Nil(t, legacy.Decode(bs))
+	assert.Nil(t, legacy.Changes)
+	assert.Equal(t, 4, len(legacy.Rows))
+	assert.Equal(t, "c", legacy.Rows[2]["name"])
+
+	// 没有配置时使用rows格式，和以前的版本兼容
+	bs2, err := dc.EncodeAs("")
+	assert.Nil(t, err)
+	assert.Equal(t, bs, bs2)
+
+	bs, err = dc.EncodeAs(FormatChanges)
+	assert.Nil(t, err)
+	changes := &DataChanged{}
+	assert.Nil(t, changes.Decode(bs))
+	assert.Nil(t, changes.Rows)
+	assert.Equal(t, 2, len(changes.Changes))
+}
+
+func TestRowKey(t *testing.T) {
+	assert.Equal(t, "", RowKey(nil, map[string]interface{}{"id": 1}, nil))
+	assert.Equal(t, "1", RowKey([]string{"id"}, map[string]interface{}{"id": int32(1)}, nil))
+	assert.Equal(t, "a", RowKey([]string{"code"}, map[string]interface{}{"code": []byte("a")}, nil))
+	assert.Equal(t, `["1","a"]`, RowKey([]string{"id", "code"}, map[string]interface{}{"id": 1, "code": "a"}, nil))
+	assert.Equal(t, "1", RowKey([]string{"id"}, map[string]interface{}{}, map[string]interface{}{"id": 1}))
+	assert.Equal(t, "", RowKey([]string{"id"}, map[string]interface{}{"name": "a"}, nil))
+}
+
+func TestPrimaryKeyInDataChanged(t *testing.T) {
+	tables := &TableMetaManager{
+		schemaConfigs: []SchemaConfig{{Name: "db1"}},
+		schemas: []Schema{{
+			Name: "db1",
+			Tables: []Table{{
+				Name: "user",
+				Columns: []Column{
+					{ColumnName: "id", OrdinalPosition: 1, IsNullable: "NO", DataType: "int", ColumnKey: "PRI"},
+					{ColumnName: "name", OrdinalPosition: 2, IsNullable: "YES", DataType: "varchar"},
+					{ColumnName: "bio", OrdinalPosition: 3, IsNullable: "YES", DataType: "text"},
+				},
+				PrimaryKey: []string{"id"},
+			}},
+		}},
+	}
+
+	// 第一行修改了主键
+	ev := updateRowsEvent(0x01, 0x03,
+		[]interface{}{1, nil, nil}, []interface{}{10, "a", nil},
+		[]interface{}{2, nil, nil}, []interface{}{2, "b", nil},
+	)
+
+	dc, err := NewDataChangedFromBinlogEvent(ev, tables)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"id"}, dc.PrimaryKey)
+	assert.Equal(t, "10", dc.Changes[0].Key)
+	assert.Equal(t, "1", dc.Changes[0].OldKey)
+	assert.Equal(t, "2", dc.Changes[1].Key)
+	assert.Equal(t, "", dc.Changes[1].OldKey)
+
+	legacy := dc.Flatten()
+	assert.Equal(t, []string{"1", "10", "2", "2"}, legacy.Keys)
+
+	// MINIMAL的后镜像中没有主键
+	minimal := updateRowsEvent(0x01, 0x02, []interface{}{3, nil, nil}, []interface{}{nil, "c", nil})
+	dc, err = NewDataChangedFromBinlogEvent(minimal, tables)
+	assert.Nil(t, err)
+	assert.Equal(t, "3", dc.Changes[0].Key)
+	assert.Equal(t, "", dc.Changes[0].OldKey)
+}
@@ -0,0 +1,126 @@
+package mysql2nsq
+
+import (
+	"regexp"
+	"strings"
+)
+
+// TableRef 表示某个库的某张表
+type TableRef struct {
+	Schema string
+	Table  string
+}
+
+const identPattern = "(?:`(?:[^`]|``)+`|[\\w$]+)"
+
+// 库名可选的表名，比如 db1.user 或者 `db1`.`user`
+const tableNamePattern = "(" + identPattern + "(?:\\s*\\.\\s*" + identPattern + ")?)"
+
+var (
+	ddlCommentRegexp  = regexp.MustCompile(`(?s)/\*.*?\*/|(?m)(?:--\s|#).*$`)
+	alterTableRegexp  = regexp.MustCompile("(?is)^ALTER\\s+(?:ONLINE\\s+|OFFLINE\\s+|IGNORE\\s+)*TABLE\\s+" + tableNamePattern + "(.*)$")
+	alterRenameRegexp = regexp.MustCompile("(?is)(?:^|,)\\s*RENAME\\s+(?:TO\\s+|AS\\s+)?" + tableNamePattern)
+	createTableRegexp = regexp.MustCompile("(?is)^CREATE\\s+TABLE\\s+(?:IF\\s+NOT\\s+EXISTS\\s+)?" + tableNamePattern)
+	dropTableRegexp   = regexp.MustCompile("(?is)^DROP\\s+TABLES?\\s+(?:IF\\s+EXISTS\\s+)?(.*?)\\s*(?:RESTRICT|CASCADE)?\\s*$")
+	renameTableRegexp = regexp.MustCompile("(?is)^RENAME\\s+TABLES?\\s+(.*)$")
+	renamePairRegexp  = regexp.MustCompile("(?is)^" + tableNamePattern + "\\s+TO\\s+" + tableNamePattern + "$")
+	tableNameRegexp   = regexp.MustCompile("(?s)^" + tableNamePattern + "$")
+)
+
+// ParseDDLTables 解析ALTER/CREATE/DROP/RENAME TABLE语句，返回会改变表结构的表
+// defaultSchema 是执行语句时的默认库（QueryEvent.Schema），语句中的表名没带库名时使用
+// 不是这几种语句时返回nil
+func ParseDDLTables(defaultSchema, query string) []TableRef {
+	query = strings.TrimSpace(ddlCommentRegexp.ReplaceAllString(query, " "))
+	query = strings.TrimSuffix(query, ";")
+
+	if m := alterTableRegexp.FindStringSubmatch(query); m != nil {
+		refs := []TableRef{parseTableName(defaultSchema, m[1])}
+		// ALTER TABLE t1 RENAME TO t2
+		for _, rm := range alterRenameRegexp.FindAllStringSubmatch(m[2], -1) {
+			switch strings.ToUpper(rm[1]) {
+			case "COLUMN", "INDEX", "KEY":
+				// RENAME COLUMN/INDEX/KEY 不改变表名
+				continue
+			}
+			refs = append(refs, parseTableName(refs[0].Schema, rm[1]))
+		}
+		return refs
+	}
+
+	if m := createTableRegexp.FindStringSubmatch(query); m != nil {
+		return []TableRef{parseTableName(defaultSchema, m[1])}
+	}
+
+	if m := dropTableRegexp.FindStringSubmatch(query); m != nil {
+		var refs []TableRef
+		for _, name := range splitNames(m[1]) {
+			if tableNameRegexp.MatchString(name) {
+				refs = append(refs, parseTableName(defaultSchema, name))
+			}
+		}
+		return refs
+	}
+
+	if m := renameTableRegexp.FindStringSubmatch(query); m != nil {
+		var refs []TableRef
+		for _, pair := range splitNames(m[1]) {
+			if pm := renamePairRegexp.FindStringSubmatch(pair); pm != nil {
+				refs = append(refs, parseTableName(defaultSchema, pm[1]), parseTableName(defaultSchema, pm[2]))
+			}
+		}
+		return refs
+	}
+
+	return nil
+}
+
+// splitNames 按逗号分割，忽略反引号内的逗号
+func splitNames(s string) []string {
+	var names []string
+	var quoted bool
+	start := 0
+	for i, c := range s {
+		switch c {
+		case '`':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				names = append(names, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(names, strings.TrimSpace(s[start:]))
+}
+
+func parseTableName(defaultSchema, name string) TableRef {
+	var parts []string
+	var quoted bool
+	start := 0
+	for i, c := range name {
+		switch c {
+		case '`':
+			quoted = !quoted
+		case '.':
+			if !quoted {
+				parts = append(parts, name[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, name[start:])
+
+	if len(parts) == 1 {
+		return TableRef{Schema: defaultSchema, Table: unquoteIdent(parts[0])}
+	}
+	return TableRef{Schema: unquoteIdent(parts[0]), Table: unquoteIdent(parts[1])}
+}
+
+func unquoteIdent(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '`' && s[len(s)-1] == '`' {
+		return strings.Replace(s[1:len(s)-1], "``", "`", -1)
+	}
+	return s
+}
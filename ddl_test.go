@@ -0,0 +1,32 @@
+package mysql2nsq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDDLTables(t *testing.T) {
+	cases := []struct {
+		query string
+		refs  []TableRef
+	}{
+		{"ALTER TABLE user ADD COLUMN age int", []TableRef{{"db1", "user"}}},
+		{"alter table `db2`.`user` drop column age", []TableRef{{"db2", "user"}}},
+		{"ALTER TABLE user RENAME TO member", []TableRef{{"db1", "user"}, {"db1", "member"}}},
+		{"ALTER TABLE user RENAME COLUMN name TO nickname", []TableRef{{"db1", "user"}}},
+		{"ALTER TABLE user RENAME INDEX idx_a TO idx_b", []TableRef{{"db1", "user"}}},
+		{"CREATE TABLE IF NOT EXISTS `order` (`id` int)", []TableRef{{"db1", "order"}}},
+		{"/* hint */ CREATE TABLE db2.order_item LIKE db2.`order`", []TableRef{{"db2", "order_item"}}},
+		{"DROP TABLE `user` /* generated by server */", []TableRef{{"db1", "user"}}},
+		{"DROP TABLE IF EXISTS a, `db2`.`b`", []TableRef{{"db1", "a"}, {"db2", "b"}}},
+		{"RENAME TABLE user TO user_old, user_new TO user", []TableRef{{"db1", "user"}, {"db1", "user_old"}, {"db1", "user_new"}, {"db1", "user"}}},
+		{"CREATE DATABASE db3", nil},
+		{"TRUNCATE TABLE user", nil},
+		{"COMMIT", nil},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.refs, ParseDDLTables("db1", c.query), c.query)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/siddontang/go-mysql/mysql"
 )
@@ -107,6 +108,10 @@ func (s *fileStorage) Close() error {
 }
 
 func (s *fileStorage) writeToFile(GTIDSet mysql.GTIDSet) (err error) {
+	defer func(start time.Time) {
+		metricCheckpointWrite.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
 	b := []byte(GTIDSet.String())
 
 	var n int
@@ -119,5 +124,8 @@ func (s *fileStorage) writeToFile(GTIDSet mysql.GTIDSet) (err error) {
 		return
 	}
 
+	// 合并区间后GTIDSet可能变短，去掉文件末尾旧的内容
+	err = s.file.Truncate(int64(len(b)))
+
 	return
 }
@@ -85,3 +85,26 @@ func writeFile(fn string, content string) (err error) {
 
 	return
 }
+
+func TestUpdateShrink(t *testing.T) {
+	fn := "shrink_gtidset"
+	defer os.Remove(fn)
+
+	storage, err := newFileStorage(fn, "")
+	if err != nil {
+		t.Fatalf("err: %s\n", err)
+	}
+	defer storage.Close()
+
+	storage.Update("36c0fcec-5447-11ea-8dc1-0242ac110002:1-3:5-7294")
+	// 合并区间后变短
+	storage.Update("36c0fcec-5447-11ea-8dc1-0242ac110002:4")
+
+	s, err := storage.Read()
+	if err != nil {
+		t.Fatalf("err: %s\n", err)
+	}
+	if s.String() != "36c0fcec-5447-11ea-8dc1-0242ac110002:1-7294" {
+		t.Fatalf("read: %s\n", s)
+	}
+}
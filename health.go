@@ -0,0 +1,28 @@
+package mysql2nsq
+
+import (
+	"net/http"
+)
+
+// NewHealthHandler 返回健康检查接口
+//
+//	GET /healthz  存活检查，同步的循环卡住时返回503
+//	GET /readyz   就绪检查，没有连接mysql或者sink不可用时返回503
+func NewHealthHandler(runner *Runner) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", healthCheck(runner.Live))
+	mux.Handle("/readyz", healthCheck(runner.Ready))
+	return mux
+}
+
+func healthCheck(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
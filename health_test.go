@@ -0,0 +1,106 @@
+package mysql2nsq
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/stretchr/testify/assert"
+)
+
+// pingSink 是可以检查是否可用的memSink
+type pingSink struct {
+	memSink
+	pingErr error
+}
+
+func (s *pingSink) Ping() error {
+	return s.pingErr
+}
+
+func TestHealthHandler(t *testing.T) {
+	sink := &pingSink{}
+	r := NewRunner(Config{Health: HealthConfig{LivenessTimeout: Duration{time.Minute}}}, newTestTableMetaManager(), &memStorage{}, sink)
+	h := NewHealthHandler(r)
+
+	assert.Equal(t, http.StatusOK, adminRequest(h, "GET", "/healthz").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, adminRequest(h, "GET", "/readyz").Code)
+
+	r.setConnected(true)
+	assert.Equal(t, http.StatusOK, adminRequest(h, "GET", "/readyz").Code)
+
+	sink.pingErr = errors.New("nsqd down")
+	w := adminRequest(h, "GET", "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "sink不可用: nsqd down", w.Body.String())
+
+	// 卡住了
+	r.lastProgress = time.Now().Add(-2 * time.Minute)
+	assert.Equal(t, http.StatusServiceUnavailable, adminRequest(h, "GET", "/healthz").Code)
+
+	// 暂停时不算卡住
+	r.Pause()
+	assert.Equal(t, http.StatusOK, adminRequest(h, "GET", "/healthz").Code)
+}
+
+func TestRunnerLiveDuringReload(t *testing.T) {
+	r := NewRunner(Config{}, newTestTableMetaManager(), &memStorage{}, &memSink{})
+
+	// /healthz在HTTP的goroutine中调用Live，同时同步的goroutine应用新的配置，go test -race不能报告数据竞争
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				assert.Nil(t, r.Live())
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, r.Reload(Config{Health: HealthConfig{LivenessTimeout: Duration{time.Duration(i+1) * time.Minute}}}))
+		assert.Nil(t, r.applyReloaded())
+	}
+	close(stop)
+	<-done
+	assert.Equal(t, 1000*time.Minute, r.config.Health.livenessTimeout())
+}
+
+// silentStreamer 一直没有事件
+type silentStreamer struct{}
+
+func (silentStreamer) GetEvent(ctx context.Context) (*replication.BinlogEvent, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRunnerWatchdog(t *testing.T) {
+	r := NewRunner(Config{
+		Health:    HealthConfig{StreamTimeout: Duration{time.Millisecond}},
+		Reconnect: ReconnectConfig{InitialInterval: Duration{time.Millisecond}},
+	}, newTestTableMetaManager(), &memStorage{}, &memSink{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	restarts := metricWatchdogRestarts.Value()
+	var connects int
+	r.connect = func(GTIDSet mysql.GTIDSet) (eventStreamer, error) {
+		connects++
+		if connects == 2 {
+			cancel()
+		}
+		return silentStreamer{}, nil
+	}
+
+	assert.Nil(t, r.Run(ctx))
+	assert.Equal(t, 2, connects)
+	assert.Equal(t, restarts+1, metricWatchdogRestarts.Value())
+}
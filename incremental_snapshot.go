@@ -0,0 +1,314 @@
+package mysql2nsq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+const (
+	// SignalSnapshot 是signal_table中请求增量快照的行的type，data是"库名.表名"
+	SignalSnapshot      = "snapshot"
+	signalLowWatermark  = "watermark-low"
+	signalHighWatermark = "watermark-high"
+
+	// watermarkTimeout 是写入水位后等待它出现在binlog中的最长时间
+	watermarkTimeout = time.Minute
+)
+
+// IncrementalSnapshotter 在同步binlog的同时，按主键分块重新发布一张表中的行，不需要停止同步或者锁表
+//
+// 使用DBLog的水位算法：读取每一块之前和之后分别在signal_table中写入低水位和高水位，
+// binlog中低水位和高水位之间这张表发生了变化的行从这一块中去掉，因为binlog中已经有更新的数据，
+// 看到高水位时把这一块剩下的行作为READ发布，这样快照的行穿插在binlog的变化之间，并且不会覆盖更新的变化
+//
+// 快照请求来自管理接口，或者在signal_table中插入type为snapshot、data为"库名.表名"的行
+// signal_table的结构：
+//
+//	CREATE TABLE mysql2nsq_signal (id VARCHAR(64) PRIMARY KEY, type VARCHAR(32) NOT NULL, data VARCHAR(2048))
+//
+// 水位的行不会被删除，可以随时清理
+//
+// 等待的表和当前表的进度只保存在内存中，重启后丢失，需要重新请求，请求后从头开始
+type IncrementalSnapshotter struct {
+	config SnapshotConfig
+	signal TableRef
+	tmm    *TableMetaManager
+	conn   incrementalConn
+
+	lock    sync.Mutex
+	pending []TableRef
+
+	// 以下只在同步binlog的goroutine中使用
+	current *incrementalTable
+	window  *watermarkWindow
+}
+
+// incrementalTable 是正在做快照的表
+type incrementalTable struct {
+	ref     TableRef
+	table   *Table
+	lastKey []interface{}
+}
+
+// watermarkWindow 是一块数据和它的水位
+type watermarkWindow struct {
+	low, high string
+	// open 表示binlog中已经出现了低水位
+	open bool
+	rows []map[string]interface{}
+	// keys 是rows中还没有在窗口中发生变化的行的主键
+	keys      map[string]bool
+	createdAt time.Time
+}
+
+// incrementalConn 写入水位并读取数据，测试时替换
+type incrementalConn interface {
+	chunkReader
+	writeSignal(ctx context.Context, signal TableRef, id, kind, data string) error
+}
+
+// NewIncrementalSnapshotter 返回IncrementalSnapshotter实例，config.SignalTable是"库名.表名"
+func NewIncrementalSnapshotter(db *sql.DB, tmm *TableMetaManager, config SnapshotConfig) (*IncrementalSnapshotter, error) {
+	signal, err := parseTableRef(config.SignalTable)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signal_table: %s", err)
+	}
+
+	return &IncrementalSnapshotter{
+		config: config,
+		signal: signal,
+		tmm:    tmm,
+		conn:   &sqlIncrementalConn{db: db},
+	}, nil
+}
+
+func parseTableRef(name string) (TableRef, error) {
+	parts := strings.SplitN(strings.TrimSpace(name), ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return TableRef{}, fmt.Errorf("%s is not schema.table", name)
+	}
+	return TableRef{Schema: parts[0], Table: parts[1]}, nil
+}
+
+// Request 请求对表做增量快照，表已经在等待中时忽略
+func (s *IncrementalSnapshotter) Request(schemaName, tableName string) error {
+	table, err := s.tmm.Query(schemaName, tableName)
+	if err != nil {
+		return fmt.Errorf("%s.%s: %s", schemaName, tableName, err)
+	}
+	if len(table.PrimaryKey) == 0 {
+		return fmt.Errorf("表%s.%s没有主键，不能分块读取", schemaName, tableName)
+	}
+
+	ref := TableRef{Schema: schemaName, Table: tableName}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, pending := range s.pending {
+		if pending == ref {
+			return nil
+		}
+	}
+	s.pending = append(s.pending, ref)
+	log.Infof("请求增量快照%s.%s\n", schemaName, tableName)
+	return nil
+}
+
+// Pending 返回等待做快照的表，包括正在做快照的表
+func (s *IncrementalSnapshotter) Pending() []TableRef {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]TableRef(nil), s.pending...)
+}
+
+// step 在处理binlog事件之间调用，没有等待中的窗口时读取下一块
+// 等待水位超时时丢弃当前的块，从上一块的末尾重新读取；读取出错时放弃当前的表
+func (s *IncrementalSnapshotter) step(ctx context.Context) {
+	if s.window != nil {
+		if time.Since(s.window.createdAt) <= watermarkTimeout {
+			return
+		}
+		log.Warnf("%s内没有在binlog中看到水位，重新读取增量快照%s.%s的这一块，请检查signal_table是否在binlog中\n",
+			watermarkTimeout, s.current.ref.Schema, s.current.ref.Table)
+		s.window = nil
+	}
+
+	if s.current == nil {
+		s.lock.Lock()
+		if len(s.pending) > 0 {
+			ref := s.pending[0]
+			s.current = &incrementalTable{ref: ref}
+		}
+		s.lock.Unlock()
+		if s.current == nil {
+			return
+		}
+		log.Infof("开始增量快照%s.%s\n", s.current.ref.Schema, s.current.ref.Table)
+	}
+
+	if err := s.readWindow(ctx); err != nil {
+		log.Errorf("增量快照%s.%s失败: %s\n", s.current.ref.Schema, s.current.ref.Table, err)
+		s.finish()
+	}
+}
+
+// readWindow 写入低水位，读取下一块，再写入高水位
+func (s *IncrementalSnapshotter) readWindow(ctx context.Context) error {
+	c := s.current
+	table, err := s.tmm.Query(c.ref.Schema, c.ref.Table)
+	if err != nil {
+		return err
+	}
+	c.table = table
+
+	low, high := uuid.Must(uuid.NewV4()).String(), uuid.Must(uuid.NewV4()).String()
+	data := c.ref.Schema + "." + c.ref.Table
+	if err = s.conn.writeSignal(ctx, s.signal, low, signalLowWatermark, data); err != nil {
+		return fmt.Errorf("write low watermark failed: %s", err)
+	}
+	rows, err := s.conn.readChunk(ctx, c.ref.Schema, table, c.lastKey, "", s.config.chunkSize())
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		log.Infof("增量快照%s.%s完成\n", c.ref.Schema, c.ref.Table)
+		s.finish()
+		return nil
+	}
+	if err = s.conn.writeSignal(ctx, s.signal, high, signalHighWatermark, data); err != nil {
+		return fmt.Errorf("write high watermark failed: %s", err)
+	}
+
+	w := &watermarkWindow{low: low, high: high, rows: rows, keys: make(map[string]bool), createdAt: time.Now()}
+	for _, row := range rows {
+		w.keys[RowKey(table.PrimaryKey, row, nil)] = true
+	}
+	s.window = w
+	return nil
+}
+
+// finish 结束当前的表
+func (s *IncrementalSnapshotter) finish() {
+	if s.current == nil {
+		return
+	}
+
+	s.lock.Lock()
+	for i, ref := range s.pending {
+		if ref == s.current.ref {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			break
+		}
+	}
+	s.lock.Unlock()
+
+	s.current = nil
+	s.window = nil
+}
+
+// reset 在从较早的位置重新同步binlog时调用，丢弃没有看到高水位的块，之后重新读取
+func (s *IncrementalSnapshotter) reset() {
+	s.window = nil
+}
+
+// isSignal 返回表是不是signal_table
+func (s *IncrementalSnapshotter) isSignal(schemaName, tableName string) bool {
+	return s.signal.Schema == schemaName && s.signal.Table == tableName
+}
+
+// handleSignal 处理signal_table中插入的行，看到当前块的高水位时返回这一块要发布的数据
+func (s *IncrementalSnapshotter) handleSignal(ev *replication.BinlogEvent, e *replication.RowsEvent) *DataChanged {
+	if ev.Header.EventType != replication.WRITE_ROWS_EVENTv2 {
+		return nil
+	}
+
+	var emit *DataChanged
+	for _, row := range e.Rows {
+		if len(row) < 3 {
+			continue
+		}
+		id, kind, data := keyValue(row[0]), keyValue(row[1]), keyValue(row[2])
+
+		switch kind {
+		case SignalSnapshot:
+			ref, err := parseTableRef(data)
+			if err == nil {
+				err = s.Request(ref.Schema, ref.Table)
+			}
+			if err != nil {
+				log.Errorf("增量快照请求%s无效: %s\n", id, err)
+			}
+		case signalLowWatermark:
+			if s.window != nil && id == s.window.low {
+				s.window.open = true
+			}
+		case signalHighWatermark:
+			if s.window != nil && s.window.open && id == s.window.high {
+				emit = s.closeWindow()
+			}
+		}
+	}
+	return emit
+}
+
+// closeWindow 返回这一块中在窗口内没有发生变化的行，并准备读取下一块
+func (s *IncrementalSnapshotter) closeWindow() *DataChanged {
+	c, w := s.current, s.window
+	s.window = nil
+
+	var rows []map[string]interface{}
+	for _, row := range w.rows {
+		if w.keys[RowKey(c.table.PrimaryKey, row, nil)] {
+			rows = append(rows, row)
+		}
+	}
+	c.lastKey = chunkKey(c.table.PrimaryKey, w.rows[len(w.rows)-1])
+	log.Debugf("增量快照%s.%s的一块：读取%d行，发布%d行\n", c.ref.Schema, c.ref.Table, len(w.rows), len(rows))
+
+	if len(w.rows) < s.config.chunkSize() {
+		log.Infof("增量快照%s.%s完成\n", c.ref.Schema, c.ref.Table)
+		s.finish()
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	metricSnapshotRows.Add(float64(len(rows)))
+	return snapshotDataChanged(c.ref.Schema, c.table, rows, READ, time.Now())
+}
+
+// observe 在窗口打开时，从这一块中去掉binlog中发生了变化的行
+func (s *IncrementalSnapshotter) observe(dc *DataChanged) {
+	w := s.window
+	if w == nil || !w.open || dc.Schema != s.current.ref.Schema || dc.Table != s.current.ref.Table {
+		return
+	}
+
+	for _, c := range dc.Changes {
+		delete(w.keys, c.Key)
+		if c.OldKey != "" {
+			delete(w.keys, c.OldKey)
+		}
+	}
+}
+
+// sqlIncrementalConn 用database/sql写入水位和读取数据
+type sqlIncrementalConn struct {
+	db *sql.DB
+}
+
+func (c *sqlIncrementalConn) writeSignal(ctx context.Context, signal TableRef, id, kind, data string) error {
+	q := fmt.Sprintf("INSERT INTO %s.%s (id, type, data) VALUES (?, ?, ?)", quoteIdent(signal.Schema), quoteIdent(signal.Table))
+	_, err := c.db.ExecContext(ctx, q, id, kind, data)
+	return err
+}
+
+func (c *sqlIncrementalConn) readChunk(ctx context.Context, schemaName string, table *Table, after []interface{}, where string, limit int) ([]map[string]interface{}, error) {
+	return readChunk(ctx, c.db, schemaName, table, after, where, limit)
+}
@@ -0,0 +1,139 @@
+package mysql2nsq
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeIncrementalConn 记录写入的水位，从内存中读取数据
+type fakeIncrementalConn struct {
+	fakeSnapshotConn
+	signals [][]interface{}
+}
+
+func (c *fakeIncrementalConn) writeSignal(ctx context.Context, signal TableRef, id, kind, data string) error {
+	c.signals = append(c.signals, []interface{}{id, kind, data})
+	return nil
+}
+
+func signalEvent(rows ...[]interface{}) *replication.BinlogEvent {
+	return rowsEvent("db1", "mysql2nsq_signal", rows...)
+}
+
+func newTestIncrementalRunner(t *testing.T, conn *fakeIncrementalConn) (*Runner, *memSink) {
+	sink := &memSink{}
+	tmm := newSnapshotTableMetaManager()
+	r := NewRunner(Config{MessageFormat: FormatChanges}, tmm, &memStorage{}, sink)
+
+	incremental, err := NewIncrementalSnapshotter(nil, tmm, SnapshotConfig{ChunkSize: 2, SignalTable: "db1.mysql2nsq_signal"})
+	assert.Nil(t, err)
+	incremental.conn = conn
+	r.SetIncrementalSnapshotter(incremental)
+	return r, sink
+}
+
+func TestIncrementalSnapshot(t *testing.T) {
+	conn := &fakeIncrementalConn{fakeSnapshotConn: fakeSnapshotConn{rows: snapshotRows(3)}}
+	r, sink := newTestIncrementalRunner(t, conn)
+	ctx := context.Background()
+
+	assert.Nil(t, r.SnapshotTable("db1", "user"))
+	assert.Nil(t, r.SnapshotTable("db1", "user"))
+	assert.Equal(t, []TableRef{{Schema: "db1", Table: "user"}}, r.incremental.Pending())
+
+	// 第一块：读取id为1和2的行，窗口中id为2的行发生了变化
+	r.incremental.step(ctx)
+	assert.Equal(t, 2, len(conn.signals))
+	low, high := conn.signals[0], conn.signals[1]
+	assert.Equal(t, signalLowWatermark, low[1])
+	assert.Equal(t, signalHighWatermark, high[1])
+
+	// 窗口之前的变化不影响这一块
+	assert.Nil(t, r.handleEvent(ctx, gtidEvent(1)))
+	assert.Nil(t, r.handleEvent(ctx, rowsEvent("db1", "user", []interface{}{1, "before"})))
+	assert.Nil(t, r.handleEvent(ctx, xidEvent()))
+
+	for _, ev := range []*replication.BinlogEvent{
+		gtidEvent(2), signalEvent(low), xidEvent(),
+		gtidEvent(3), rowsEvent("db1", "user", []interface{}{2, "changed"}), xidEvent(),
+	} {
+		assert.Nil(t, r.handleEvent(ctx, ev))
+	}
+	// 看到高水位之前不读取下一块
+	r.incremental.step(ctx)
+	assert.Equal(t, 2, len(conn.signals))
+	for _, ev := range []*replication.BinlogEvent{gtidEvent(4), signalEvent(high), xidEvent()} {
+		assert.Nil(t, r.handleEvent(ctx, ev))
+	}
+
+	// 第二块：id为3的行，不满一块时表完成
+	r.incremental.step(ctx)
+	assert.Equal(t, []interface{}{int64(2)}, conn.queries[1])
+	low, high = conn.signals[2], conn.signals[3]
+	for _, ev := range []*replication.BinlogEvent{gtidEvent(5), signalEvent(low, high), xidEvent()} {
+		assert.Nil(t, r.handleEvent(ctx, ev))
+	}
+	assert.Equal(t, 0, len(r.incremental.Pending()))
+
+	var published []string
+	for _, msg := range sink.msgs {
+		var dc DataChanged
+		assert.Nil(t, dc.Decode(msg.Body))
+		for _, c := range dc.Changes {
+			published = append(published, string(dc.Action)+":"+c.Key+":"+c.After["name"].(string))
+		}
+	}
+	assert.Equal(t, []string{"INSERT:1:before", "INSERT:2:changed", "READ:1:user", "READ:3:user"}, published)
+}
+
+func TestIncrementalSnapshotSignal(t *testing.T) {
+	conn := &fakeIncrementalConn{fakeSnapshotConn: fakeSnapshotConn{rows: snapshotRows(1)}}
+	r, _ := newTestIncrementalRunner(t, conn)
+	ctx := context.Background()
+
+	// 在signal_table中插入请求
+	assert.Nil(t, r.handleEvent(ctx, signalEvent([]interface{}{"req-1", SignalSnapshot, "db1.user"}, []interface{}{"req-2", SignalSnapshot, "db1.unknown"})))
+	assert.Equal(t, []TableRef{{Schema: "db1", Table: "user"}}, r.incremental.Pending())
+
+	// 重新同步时丢弃没有看到高水位的块，之后重新读取
+	r.incremental.step(ctx)
+	set, _ := mysql.ParseMysqlGTIDSet("")
+	r.reset(set)
+	r.incremental.step(ctx)
+	assert.Equal(t, 4, len(conn.signals))
+	assert.Equal(t, []interface{}(nil), conn.queries[1])
+
+	// 等待水位超时时丢弃这一块，从同一个主键重新读取，不放弃这张表
+	r.incremental.window.createdAt = time.Now().Add(-watermarkTimeout - time.Second)
+	r.incremental.step(ctx)
+	assert.Equal(t, 6, len(conn.signals))
+	assert.Equal(t, []interface{}(nil), conn.queries[2])
+	assert.Equal(t, []TableRef{{Schema: "db1", Table: "user"}}, r.incremental.Pending())
+	assert.Equal(t, conn.signals[4][0], r.incremental.window.low)
+}
+
+func TestAdminSnapshot(t *testing.T) {
+	conn := &fakeIncrementalConn{}
+	r, _ := newTestIncrementalRunner(t, conn)
+	h := NewAdminHandler(r)
+
+	w := adminRequest(h, "POST", "/admin/snapshot?table=db1.user")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var pending []TableRef
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &pending))
+	assert.Equal(t, []TableRef{{Schema: "db1", Table: "user"}}, pending)
+
+	assert.Equal(t, http.StatusBadRequest, adminRequest(h, "POST", "/admin/snapshot?table=user").Code)
+	assert.Equal(t, http.StatusBadRequest, adminRequest(h, "POST", "/admin/snapshot?table=db1.unknown").Code)
+
+	// 没有配置signal_table
+	h = NewAdminHandler(NewRunner(Config{}, newTestTableMetaManager(), &memStorage{}, &memSink{}))
+	assert.Equal(t, http.StatusBadRequest, adminRequest(h, "POST", "/admin/snapshot?table=db1.user").Code)
+}
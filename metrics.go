@@ -0,0 +1,295 @@
+package mysql2nsq
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter 是只增不减的计数
+type Counter struct {
+	bits uint64
+}
+
+// Inc 加1
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add 加上v，v不能小于0
+func (c *Counter) Add(v float64) {
+	addFloat64(&c.bits, v)
+}
+
+// Value 返回当前值
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+func (c *Counter) samples() []sample {
+	return []sample{{value: c.Value()}}
+}
+
+// Gauge 是可以任意设置的值
+type Gauge struct {
+	bits uint64
+}
+
+// Set 设置为v
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Add 加上v
+func (g *Gauge) Add(v float64) {
+	addFloat64(&g.bits, v)
+}
+
+// Value 返回当前值
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+func (g *Gauge) samples() []sample {
+	return []sample{{value: g.Value()}}
+}
+
+// CounterVec 是按标签区分的一组Counter
+type CounterVec struct {
+	labelNames []string
+
+	lock     sync.RWMutex
+	counters map[string]*labeledCounter
+}
+
+type labeledCounter struct {
+	labelValues []string
+	counter     Counter
+}
+
+// With 返回标签值为labelValues的Counter，labelValues的顺序和个数与标签名相同
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	key := strings.Join(labelValues, "\xff")
+
+	v.lock.RLock()
+	c, ok := v.counters[key]
+	v.lock.RUnlock()
+	if ok {
+		return &c.counter
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if c, ok = v.counters[key]; !ok {
+		c = &labeledCounter{labelValues: append([]string(nil), labelValues...)}
+		v.counters[key] = c
+	}
+	return &c.counter
+}
+
+func (v *CounterVec) samples() []sample {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	samples := make([]sample, 0, len(v.counters))
+	for _, c := range v.counters {
+		samples = append(samples, sample{labels: labelPairs(v.labelNames, c.labelValues), value: c.counter.Value()})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+	return samples
+}
+
+// Histogram 统计观测值的分布
+type Histogram struct {
+	// buckets 是每个区间的上限，从小到大
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sumBits uint64
+}
+
+// Observe 记录一个观测值
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	addFloat64(&h.sumBits, v)
+}
+
+func (h *Histogram) samples() []sample {
+	samples := make([]sample, 0, len(h.buckets)+3)
+	var cumulative uint64
+	for i, upper := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		samples = append(samples, sample{
+			suffix: "_bucket",
+			labels: labelPairs([]string{"le"}, []string{formatFloat(upper)}),
+			value:  float64(cumulative),
+		})
+	}
+	count := float64(atomic.LoadUint64(&h.count))
+	return append(samples,
+		sample{suffix: "_bucket", labels: `le="+Inf"`, value: count},
+		sample{suffix: "_sum", value: math.Float64frombits(atomic.LoadUint64(&h.sumBits))},
+		sample{suffix: "_count", value: count},
+	)
+}
+
+func addFloat64(bits *uint64, v float64) {
+	for {
+		old := atomic.LoadUint64(bits)
+		n := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(bits, old, n) {
+			return
+		}
+	}
+}
+
+// sample 是指标的一个值，suffix 加在指标名后面，labels 是格式化后的标签
+type sample struct {
+	suffix string
+	labels string
+	value  float64
+}
+
+type collector interface {
+	samples() []sample
+}
+
+type metric struct {
+	name      string
+	help      string
+	typ       string
+	collector collector
+}
+
+var (
+	metricsLock sync.RWMutex
+	metrics     []metric
+)
+
+func newCounter(name, help string) *Counter {
+	c := &Counter{}
+	registerMetric(name, help, "counter", c)
+	return c
+}
+
+func newGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	registerMetric(name, help, "gauge", g)
+	return g
+}
+
+func newCounterVec(name, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{labelNames: labelNames, counters: make(map[string]*labeledCounter)}
+	registerMetric(name, help, "counter", v)
+	return v
+}
+
+func newHistogram(name, help string, buckets ...float64) *Histogram {
+	h := &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	registerMetric(name, help, "histogram", h)
+	return h
+}
+
+func registerMetric(name, help, typ string, c collector) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	metrics = append(metrics, metric{name: name, help: help, typ: typ, collector: c})
+}
+
+// MetricsSnapshot 返回所有指标的当前值，key是指标名加上标签，比如`name{label="value"}`
+func MetricsSnapshot() map[string]float64 {
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+
+	snapshot := make(map[string]float64, len(metrics))
+	for _, m := range metrics {
+		for _, s := range m.collector.samples() {
+			snapshot[sampleName(m.name, s)] = s.value
+		}
+	}
+	return snapshot
+}
+
+// WriteMetrics 把所有指标以Prometheus的文本格式写到w
+func WriteMetrics(w io.Writer) error {
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n", m.name, strings.Replace(m.help, "\n", " ", -1))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", m.name, m.typ)
+		for _, s := range m.collector.samples() {
+			fmt.Fprintf(bw, "%s %s\n", sampleName(m.name, s), formatFloat(s.value))
+		}
+	}
+	return bw.Flush()
+}
+
+// MetricsHandler 返回以Prometheus的文本格式输出所有指标的http.Handler
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w)
+	})
+}
+
+func sampleName(name string, s sample) string {
+	if s.labels == "" {
+		return name + s.suffix
+	}
+	return name + s.suffix + "{" + s.labels + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelPairs(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + labelValueReplacer.Replace(value) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	metricPublishRetries      = newCounter("mysql2nsq_publish_retries_total", "发布失败后的重试次数")
+	metricPublishFailures     = newCounter("mysql2nsq_publish_failures_total", "发布失败的次数，包括重试失败")
+	metricPublishStalls       = newCounter("mysql2nsq_publish_stalls_total", "因为发布失败暂停读取binlog的次数")
+	metricPublishStallSeconds = newCounter("mysql2nsq_publish_stall_seconds_total", "因为发布失败暂停读取binlog的总时长")
+	metricPublishStalled      = newGauge("mysql2nsq_publish_stalled", "当前是否因为发布失败暂停读取binlog")
+	metricRowsPublished       = newCounterVec("mysql2nsq_rows_published_total", "发布的行数", "schema", "table", "action")
+	metricConversionErrors    = newCounterVec("mysql2nsq_conversion_errors_total", "把binlog事件转换成DataChanged失败的次数，reason是not_found（没有表结构）或者other", "reason")
+	metricBinlogEvents        = newCounterVec("mysql2nsq_binlog_events_total", "读到的binlog事件数", "type")
+	metricBinlogReconnects    = newCounter("mysql2nsq_binlog_reconnects_total", "binlog连接断开后的重连次数")
+	metricWatchdogRestarts    = newCounter("mysql2nsq_watchdog_restarts_total", "一段时间内没有收到事件或心跳而重新连接的次数")
+	metricBinlogConnected     = newGauge("mysql2nsq_binlog_connected", "当前是否连接着mysql")
+	metricReplicationLag      = newGauge("mysql2nsq_replication_lag_seconds", "最近一个事件的时间到处理它的时间的间隔")
+	metricCheckpointWrite     = newHistogram("mysql2nsq_checkpoint_write_seconds", "把GTIDSet写入文件的耗时",
+		.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1)
+)
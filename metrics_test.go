@@ -0,0 +1,76 @@
+package mysql2nsq
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterAndGauge(t *testing.T) {
+	c := &Counter{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	c.Add(0.5)
+	assert.Equal(t, 1000.5, c.Value())
+
+	g := &Gauge{}
+	g.Set(3)
+	g.Add(-1)
+	assert.Equal(t, float64(2), g.Value())
+}
+
+func TestCounterVec(t *testing.T) {
+	v := &CounterVec{labelNames: []string{"schema", "table"}, counters: make(map[string]*labeledCounter)}
+	v.With("db1", "user").Inc()
+	v.With("db1", "user").Add(2)
+	v.With("db1", `a"b`).Inc()
+
+	assert.Equal(t, []sample{
+		{labels: `schema="db1",table="a\"b"`, value: 1},
+		{labels: `schema="db1",table="user"`, value: 3},
+	}, v.samples())
+}
+
+func TestHistogram(t *testing.T) {
+	h := &Histogram{buckets: []float64{0.1, 1}, counts: make([]uint64, 2)}
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	assert.Equal(t, []sample{
+		{suffix: "_bucket", labels: `le="0.1"`, value: 2},
+		{suffix: "_bucket", labels: `le="1"`, value: 3},
+		{suffix: "_bucket", labels: `le="+Inf"`, value: 4},
+		{suffix: "_sum", value: 2.65},
+		{suffix: "_count", value: 4},
+	}, h.samples())
+}
+
+func TestWriteMetrics(t *testing.T) {
+	metricConversionErrors.With("not_found").Inc()
+
+	var buf bytes.Buffer
+	assert.Nil(t, WriteMetrics(&buf))
+	text := buf.String()
+	assert.True(t, strings.Contains(text, "# TYPE mysql2nsq_publish_retries_total counter\n"))
+	assert.True(t, strings.Contains(text, "# TYPE mysql2nsq_checkpoint_write_seconds histogram\n"))
+	assert.True(t, strings.Contains(text, `mysql2nsq_conversion_errors_total{reason="not_found"} `))
+
+	snapshot := MetricsSnapshot()
+	_, ok := snapshot["mysql2nsq_publish_retries_total"]
+	assert.True(t, ok)
+	assert.True(t, snapshot[`mysql2nsq_conversion_errors_total{reason="not_found"}`] >= 1)
+}
@@ -0,0 +1,128 @@
+package mysql2nsq
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// PositionStorage 维护最新的binlog文件名和位置，用于没有开启GTID的mysql
+type PositionStorage interface {
+
+	// 事务提交或者切换binlog文件时，更新为下一个事件的位置
+	Update(pos mysql.Position) error
+
+	// 读取最新的位置
+	Read() (mysql.Position, error)
+}
+
+// NewPositionStorage 构造一个PositionStorage
+// filePath 是存储位置的文件路径，内容是"文件名:位置"
+// initPosition 是初始位置，格式相同，只在filePath指定的文件中没有读到位置时使用，为空时从最早的binlog开始
+func NewPositionStorage(filePath string, initPosition string) (PositionStorage, error) {
+	return newFilePositionStorage(filePath, initPosition)
+}
+
+// ParsePosition 解析"文件名:位置"格式的binlog位置，空字符串返回零值
+func ParsePosition(s string) (mysql.Position, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return mysql.Position{}, nil
+	}
+
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return mysql.Position{}, fmt.Errorf("invalid binlog position %q, expect file:pos", s)
+	}
+	pos, err := strconv.ParseUint(s[i+1:], 10, 32)
+	if err != nil {
+		return mysql.Position{}, fmt.Errorf("invalid binlog position %q: %s", s, err)
+	}
+	return mysql.Position{Name: s[:i], Pos: uint32(pos)}, nil
+}
+
+// FormatPosition 返回"文件名:位置"格式的binlog位置
+func FormatPosition(pos mysql.Position) string {
+	return fmt.Sprintf("%s:%d", pos.Name, pos.Pos)
+}
+
+func newFilePositionStorage(filePath string, initPosition string) (*filePositionStorage, error) {
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// 从文件中读取位置，没有时使用初始值
+	b, err := ioutil.ReadAll(file)
+	if err == nil && len(strings.TrimSpace(string(b))) == 0 {
+		b = []byte(initPosition)
+	}
+	var pos mysql.Position
+	if err == nil {
+		pos, err = ParsePosition(string(b))
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &filePositionStorage{file: file, latest: pos}, nil
+}
+
+type filePositionStorage struct {
+	file   *os.File
+	lock   sync.Mutex
+	latest mysql.Position
+}
+
+// Update implement PositionStorage
+func (s *filePositionStorage) Update(pos mysql.Position) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.writeToFile(pos); err != nil {
+		return err
+	}
+	s.latest = pos
+	return nil
+}
+
+// Read implement PositionStorage
+func (s *filePositionStorage) Read() (mysql.Position, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.latest, nil
+}
+
+func (s *filePositionStorage) Close() error {
+	return s.file.Close()
+}
+
+func (s *filePositionStorage) writeToFile(pos mysql.Position) (err error) {
+	defer func(start time.Time) {
+		metricCheckpointWrite.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	b := []byte(FormatPosition(pos))
+
+	var n int
+	if n, err = s.file.WriteAt(b, 0); err != nil {
+		return
+	}
+
+	if n != len(b) {
+		err = ErrSyncToFile
+		return
+	}
+
+	// 新的文件名或位置可能更短，去掉文件末尾旧的内容
+	err = s.file.Truncate(int64(len(b)))
+
+	return
+}
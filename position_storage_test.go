@@ -0,0 +1,59 @@
+package mysql2nsq
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePosition(t *testing.T) {
+	pos, err := ParsePosition("mysql-bin.000003:1234")
+	assert.Nil(t, err)
+	assert.Equal(t, mysql.Position{Name: "mysql-bin.000003", Pos: 1234}, pos)
+	assert.Equal(t, "mysql-bin.000003:1234", FormatPosition(pos))
+
+	pos, err = ParsePosition("")
+	assert.Nil(t, err)
+	assert.Equal(t, mysql.Position{}, pos)
+
+	for _, s := range []string{"mysql-bin.000003", ":4", "mysql-bin.000003:x", "mysql-bin.000003:-1"} {
+		_, err = ParsePosition(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestFilePositionStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "position")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "position.db")
+
+	// 文件为空时使用初始位置
+	storage, err := newFilePositionStorage(path, "mysql-bin.000003:4")
+	assert.Nil(t, err)
+	pos, err := storage.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, mysql.Position{Name: "mysql-bin.000003", Pos: 4}, pos)
+
+	assert.Nil(t, storage.Update(mysql.Position{Name: "mysql-bin.000003", Pos: 123456}))
+	assert.Nil(t, storage.Update(mysql.Position{Name: "mysql-bin.000004", Pos: 4}))
+	assert.Nil(t, storage.Close())
+
+	// 重新打开时使用文件中的位置，变短的内容没有残留
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "mysql-bin.000004:4", string(b))
+	storage, err = newFilePositionStorage(path, "mysql-bin.000003:4")
+	assert.Nil(t, err)
+	defer storage.Close()
+	pos, err = storage.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, mysql.Position{Name: "mysql-bin.000004", Pos: 4}, pos)
+
+	_, err = newFilePositionStorage(filepath.Join(dir, "invalid.db"), "mysql-bin.000003")
+	assert.NotNil(t, err)
+}
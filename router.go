@@ -0,0 +1,427 @@
+package mysql2nsq
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	// DefaultTopic 是默认的topic模板，每个库一个topic
+	DefaultTopic = "{schema}"
+	// nsq的topic最长64个字符
+	maxTopicLength = 64
+)
+
+var metricTopicFallbacks = newCounter("mysql2nsq_topic_fallbacks_total", "行展开topic模板后为空，改用默认topic的次数")
+
+var (
+	topicPlaceholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+	rowPlaceholderRegexp   = regexp.MustCompile(`\{row\.([^{}]+)\}`)
+	// nsq的topic只能包含 . a-z A-Z 0-9 _ -
+	topicInvalidCharRegexp = regexp.MustCompile(`[^.a-zA-Z0-9_-]`)
+)
+
+// Router 根据配置的topic模板决定消息的topic
+//
+// 模板中可以使用{schema}、{table}、{action}（小写的insert、update、delete、read、backfill），
+// 表的配置优先于库的配置，库的配置优先于全局配置
+// 展开后不能用作nsq topic的字符替换成_，超过64个字符的部分被截掉
+// 零值的Router使用DefaultTopic
+//
+// 以下配置按行决定topic，一个DataChanged的行发往不同topic时拆成多条消息：
+//   - 模板中的{row.字段名}展开为该行的字段值，行中没有该字段时为空；
+//     展开后topic为空时（比如字段的值是NULL）改用default_topic，没有时用表的topic模板，都用到了行的字段时用DefaultTopic
+//   - 配置了route_column的表，用该字段的值在topic_map中查找topic模板，找不到时使用default_topic，
+//     没有default_topic时使用表的topic模板
+//   - 配置了shards的表按行分片，分片是shard_key（默认是主键）的值的FNV-1a hash除以shards的余数，
+//     topic是上面得到的topic加上`.分片`，同一个key的变化总是在同一个topic中；
+//     没有主键又没有配置shard_key，或者行中没有该字段时，分到第0片
+//
+// 字段的值DELETE取自Before，其他取自After，After中没有时取自Before，所以UPDATE按修改后的值路由
+type Router struct {
+	global  string
+	schemas map[string]string
+	tables  map[TableRef]string
+	rules   map[TableRef]routeRule
+}
+
+// routeRule 是表按行决定topic的配置
+type routeRule struct {
+	shards       int
+	shardKey     string
+	column       string
+	topicMap     map[string]string
+	defaultTopic string
+}
+
+// RoutedData 是发往同一个topic的数据
+type RoutedData struct {
+	Topic string
+	Data  *DataChanged
+}
+
+// NewRouter 根据配置构造Router
+// tables 是已知的表，用来检查不同的表展开后的topic是否因为替换字符或截断而冲突
+func NewRouter(config Config, tables []TableRef) (*Router, error) {
+	r := &Router{
+		global:  config.Topic,
+		schemas: make(map[string]string),
+		tables:  make(map[TableRef]string),
+		rules:   make(map[TableRef]routeRule),
+	}
+	if err := checkTopicTemplate(r.global); err != nil {
+		return nil, err
+	}
+
+	known := make(map[TableRef]bool)
+	for _, ref := range tables {
+		known[ref] = true
+	}
+	for _, sc := range config.Schemas {
+		if err := checkTopicTemplate(sc.Topic); err != nil {
+			return nil, fmt.Errorf("schema %s: %s", sc.Name, err)
+		}
+		if sc.Topic != "" {
+			r.schemas[sc.Name] = sc.Topic
+		}
+
+		for _, name := range sc.Tables {
+			known[TableRef{Schema: sc.Name, Table: name}] = true
+		}
+		for name, tc := range sc.TableConfigs {
+			ref := TableRef{Schema: sc.Name, Table: name}
+			if err := checkTopicTemplate(tc.Topic); err != nil {
+				return nil, fmt.Errorf("table %s.%s: %s", sc.Name, name, err)
+			}
+			if tc.Topic != "" {
+				r.tables[ref] = tc.Topic
+			}
+			rule, err := newRouteRule(tc)
+			if err != nil {
+				return nil, fmt.Errorf("table %s.%s: %s", sc.Name, name, err)
+			}
+			if rule.shards > 0 || rule.column != "" {
+				r.rules[ref] = rule
+			}
+			known[ref] = true
+		}
+	}
+
+	refs := make([]TableRef, 0, len(known))
+	for ref := range known {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Schema != refs[j].Schema {
+			return refs[i].Schema < refs[j].Schema
+		}
+		return refs[i].Table < refs[j].Table
+	})
+	if err := r.checkCollisions(refs); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func newRouteRule(tc TableConfig) (routeRule, error) {
+	rule := routeRule{
+		shards:       tc.Shards,
+		shardKey:     tc.ShardKey,
+		column:       tc.RouteColumn,
+		topicMap:     tc.TopicMap,
+		defaultTopic: tc.DefaultTopic,
+	}
+	if rule.shards < 0 {
+		return rule, fmt.Errorf("invalid shards %d", rule.shards)
+	}
+	if rule.column == "" && (len(rule.topicMap) > 0 || rule.defaultTopic != "") {
+		return rule, errors.New("topic_map and default_topic require route_column")
+	}
+	if rule.column != "" && len(rule.topicMap) == 0 {
+		return rule, errors.New("route_column requires topic_map")
+	}
+
+	if err := checkTopicTemplate(rule.defaultTopic); err != nil {
+		return rule, err
+	}
+	for _, template := range rule.topicMap {
+		if err := checkTopicTemplate(template); err != nil {
+			return rule, err
+		}
+	}
+	return rule, nil
+}
+
+// checkTopicTemplate 检查模板中的变量
+func checkTopicTemplate(template string) error {
+	for _, placeholder := range topicPlaceholderRegexp.FindAllString(template, -1) {
+		switch {
+		case placeholder == "{schema}", placeholder == "{table}", placeholder == "{action}":
+		case rowPlaceholderRegexp.MatchString(placeholder):
+		default:
+			return fmt.Errorf("unknown placeholder %s in topic template %s", placeholder, template)
+		}
+	}
+	return nil
+}
+
+// checkCollisions 检查不同的表或操作的topic是否只是因为替换字符或截断才相同
+// 带有{row.字段名}的topic要到运行时才能确定，不做检查
+func (r *Router) checkCollisions(refs []TableRef) error {
+	type origin struct {
+		raw string
+		ref TableRef
+	}
+
+	seen := make(map[string]origin)
+	for _, ref := range refs {
+		for _, action := range []Action{INSERT, UPDATE, DELETE, READ, BACKFILL} {
+			rule := r.rules[ref]
+			templates := []string{r.template(ref.Schema, ref.Table)}
+			if rule.column != "" {
+				templates = templates[:0]
+				for _, template := range rule.topicMap {
+					templates = append(templates, template)
+				}
+				sort.Strings(templates)
+				templates = append(templates, r.defaultTemplate(ref, rule))
+			}
+
+			var raws []string
+			for _, template := range templates {
+				if rowPlaceholderRegexp.MatchString(template) {
+					continue
+				}
+				base := expandTopic(template, ref.Schema, ref.Table, action)
+				if rule.shards == 0 {
+					raws = append(raws, base)
+				}
+				for i := 0; i < rule.shards; i++ {
+					raws = append(raws, shardTopic(base, i))
+				}
+			}
+
+			for _, raw := range raws {
+				topic := SanitizeTopic(raw)
+				if topic == "" {
+					return fmt.Errorf("topic of %s.%s is empty", ref.Schema, ref.Table)
+				}
+
+				if prev, ok := seen[topic]; ok && prev.raw != raw {
+					return fmt.Errorf("topic collision: %s.%s (%s) and %s.%s (%s) are both published to %s",
+						prev.ref.Schema, prev.ref.Table, prev.raw, ref.Schema, ref.Table, raw, topic)
+				}
+				if _, ok := seen[topic]; !ok {
+					seen[topic] = origin{raw: raw, ref: ref}
+					if topic != raw {
+						log.Warnf("topic %s 不能用于nsq，改为 %s\n", raw, topic)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// template 返回表的topic模板
+func (r *Router) template(schemaName, tableName string) string {
+	if t, ok := r.tables[TableRef{Schema: schemaName, Table: tableName}]; ok {
+		return t
+	}
+	if t, ok := r.schemas[schemaName]; ok {
+		return t
+	}
+	if r.global != "" {
+		return r.global
+	}
+	return DefaultTopic
+}
+
+// defaultTemplate 返回route_column的值在topic_map中找不到时的topic模板
+func (r *Router) defaultTemplate(ref TableRef, rule routeRule) string {
+	if rule.defaultTopic != "" {
+		return rule.defaultTopic
+	}
+	return r.template(ref.Schema, ref.Table)
+}
+
+// Topic 返回dc的topic，按行决定topic的表返回第一行的topic
+func (r *Router) Topic(dc *DataChanged) string {
+	return r.Route(dc)[0].Topic
+}
+
+// Route 返回dc按topic拆分后的数据
+// 没有拆分时返回dc本身；拆分后每个topic一个DataChanged，行保持原来的顺序，
+// Source.RowIndexes 是每行在事务中的下标
+func (r *Router) Route(dc *DataChanged) []RoutedData {
+	ref := TableRef{Schema: dc.Schema, Table: dc.Table}
+	template := r.template(dc.Schema, dc.Table)
+	rule, ok := r.rules[ref]
+	if !ok && !rowPlaceholderRegexp.MatchString(template) {
+		return []RoutedData{{Topic: SanitizeTopic(expandTopic(template, dc.Schema, dc.Table, dc.Action)), Data: dc}}
+	}
+
+	var routed []RoutedData
+	index := make(map[string]int)
+	for i, c := range dc.Changes {
+		for _, topic := range r.rowTopics(dc, ref, rule, c) {
+			j, ok := index[topic]
+			if !ok {
+				part := *dc
+				part.Changes = nil
+				part.Source.RowIndexes = nil
+				j = len(routed)
+				index[topic] = j
+				routed = append(routed, RoutedData{Topic: topic, Data: &part})
+			}
+
+			part := routed[j].Data
+			part.Changes = append(part.Changes, c)
+			part.Source.RowIndexes = append(part.Source.RowIndexes, dc.Source.RowIndex+i)
+		}
+	}
+
+	switch len(routed) {
+	case 0:
+		return []RoutedData{{Topic: r.rowTopic(dc, ref, rule, RowChange{}), Data: dc}}
+	case 1:
+		// 所有行都在同一个topic时不需要RowIndexes
+		routed[0].Data = dc
+	}
+	return routed
+}
+
+// rowTopics 返回dc中的行c要发往的topic
+// UPDATE修改了分片的key并且换了分片时，行同时发往原来的分片，原来分片的消费者才能看到该key离开
+func (r *Router) rowTopics(dc *DataChanged, ref TableRef, rule routeRule, c RowChange) []string {
+	topic := r.baseTopic(dc, ref, rule, c)
+	if rule.shards == 0 {
+		return []string{SanitizeTopic(topic)}
+	}
+
+	shard := shardOf(rule, c)
+	current := SanitizeTopic(shardTopic(topic, shard))
+	if dc.Action != UPDATE {
+		return []string{current}
+	}
+	previous, ok := previousShard(rule, c)
+	if !ok || previous == shard {
+		return []string{current}
+	}
+	return []string{SanitizeTopic(shardTopic(topic, previous)), current}
+}
+
+// rowTopic 返回dc中的行c的topic
+func (r *Router) rowTopic(dc *DataChanged, ref TableRef, rule routeRule, c RowChange) string {
+	topic := r.baseTopic(dc, ref, rule, c)
+	if rule.shards > 0 {
+		topic = shardTopic(topic, shardOf(rule, c))
+	}
+	return SanitizeTopic(topic)
+}
+
+// baseTopic 返回行c的topic，不包括分片的后缀，也没有替换非法字符
+func (r *Router) baseTopic(dc *DataChanged, ref TableRef, rule routeRule, c RowChange) string {
+	template := r.template(dc.Schema, dc.Table)
+	if rule.column != "" {
+		var ok bool
+		if template, ok = rule.topicMap[rowValue(c, rule.column)]; !ok {
+			template = r.defaultTemplate(ref, rule)
+		}
+	}
+
+	topic := expandTopic(template, dc.Schema, dc.Table, dc.Action)
+	topic = rowPlaceholderRegexp.ReplaceAllStringFunc(topic, func(placeholder string) string {
+		return rowValue(c, rowPlaceholderRegexp.FindStringSubmatch(placeholder)[1])
+	})
+	if SanitizeTopic(topic) == "" {
+		// 比如{row.字段名}的值是NULL或者空字符串，空的topic会一直发布失败，同步会卡在这一行
+		metricTopicFallbacks.Inc()
+		log.Debugf("%s.%s的行展开topic模板%s后为空，改用%s\n", dc.Schema, dc.Table, template, r.fallbackTemplate(ref, rule))
+		topic = expandTopic(r.fallbackTemplate(ref, rule), dc.Schema, dc.Table, dc.Action)
+	}
+	return topic
+}
+
+// fallbackTemplate 返回行的topic展开后为空时使用的topic模板：
+// default_topic，没有时是表的topic模板，都用到了行的字段时是DefaultTopic
+func (r *Router) fallbackTemplate(ref TableRef, rule routeRule) string {
+	for _, template := range []string{rule.defaultTopic, r.template(ref.Schema, ref.Table)} {
+		if template != "" && !rowPlaceholderRegexp.MatchString(template) {
+			return template
+		}
+	}
+	return DefaultTopic
+}
+
+// rowValue 返回行c中字段column的值，DELETE取自Before，其他取自After，After中没有时取自Before
+func rowValue(c RowChange, column string) string {
+	row, fallback := c.After, c.Before
+	if row == nil {
+		row, fallback = c.Before, nil
+	}
+	return RowKey([]string{column}, row, fallback)
+}
+
+// shardOf 返回行c所在的分片
+func shardOf(rule routeRule, c RowChange) int {
+	key := c.Key
+	if rule.shardKey != "" {
+		key = rowValue(c, rule.shardKey)
+	}
+	return shardOfKey(rule, key)
+}
+
+// previousShard 返回UPDATE之前行c所在的分片，没有修改主键或者Before中没有shard_key时返回false
+func previousShard(rule routeRule, c RowChange) (int, bool) {
+	if rule.shardKey == "" {
+		if c.OldKey == "" {
+			return 0, false
+		}
+		return shardOfKey(rule, c.OldKey), true
+	}
+
+	if _, ok := c.Before[rule.shardKey]; !ok {
+		return 0, false
+	}
+	return shardOfKey(rule, RowKey([]string{rule.shardKey}, c.Before, nil)), true
+}
+
+func shardOfKey(rule routeRule, key string) int {
+	if key == "" {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(rule.shards))
+}
+
+func shardTopic(topic string, shard int) string {
+	return fmt.Sprintf("%s.%d", topic, shard)
+}
+
+func expandTopic(template, schemaName, tableName string, action Action) string {
+	return strings.NewReplacer(
+		"{schema}", schemaName,
+		"{table}", tableName,
+		"{action}", strings.ToLower(string(action)),
+	).Replace(template)
+}
+
+// SanitizeTopic 把不能用于nsq topic的字符替换成_，并截断到64个字符
+func SanitizeTopic(topic string) string {
+	topic = topicInvalidCharRegexp.ReplaceAllString(topic, "_")
+	if len(topic) > maxTopicLength {
+		topic = topic[:maxTopicLength]
+	}
+	return topic
+}
@@ -0,0 +1,280 @@
+package mysql2nsq
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouterTopic(t *testing.T) {
+	r, err := NewRouter(Config{
+		Topic: "cdc_{schema}_{table}_{action}",
+		Schemas: []SchemaConfig{
+			{Name: "db1", Tables: []string{"user", "order"}, TableConfigs: map[string]TableConfig{"order": {Topic: "orders"}}},
+			{Name: "db2", Topic: "{schema}.{table}"},
+		},
+	}, []TableRef{{Schema: "db2", Table: "log"}})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "cdc_db1_user_insert", r.Topic(&DataChanged{Schema: "db1", Table: "user", Action: INSERT}))
+	assert.Equal(t, "orders", r.Topic(&DataChanged{Schema: "db1", Table: "order", Action: UPDATE}))
+	assert.Equal(t, "db2.log", r.Topic(&DataChanged{Schema: "db2", Table: "log", Action: DELETE}))
+
+	// 零值使用默认模板
+	assert.Equal(t, "db1", (&Router{}).Topic(&DataChanged{Schema: "db1", Table: "user", Action: INSERT}))
+}
+
+func TestSanitizeTopic(t *testing.T) {
+	assert.Equal(t, "db1.user", SanitizeTopic("db1.user"))
+	assert.Equal(t, "db_1_user", SanitizeTopic("db$1 user"))
+	assert.Equal(t, "__", SanitizeTopic("用户"))
+	assert.Equal(t, 64, len(SanitizeTopic(strings.Repeat("a", 100))))
+}
+
+func TestRouterErrors(t *testing.T) {
+	_, err := NewRouter(Config{Topic: "{database}"}, nil)
+	assert.NotNil(t, err)
+
+	// 多张表使用同一个topic不算冲突
+	_, err = NewRouter(Config{Schemas: []SchemaConfig{{Name: "db1", Tables: []string{"a", "b"}}}}, nil)
+	assert.Nil(t, err)
+
+	// 替换字符后冲突
+	_, err = NewRouter(Config{
+		Topic:   "{schema}.{table}",
+		Schemas: []SchemaConfig{{Name: "db1", Tables: []string{"user$1", "user_1"}}},
+	}, nil)
+	assert.NotNil(t, err)
+
+	// 截断后冲突
+	long := strings.Repeat("t", 70)
+	_, err = NewRouter(Config{Topic: "{table}"}, []TableRef{{Schema: "db1", Table: long + "1"}, {Schema: "db1", Table: long + "2"}})
+	assert.NotNil(t, err)
+}
+
+func TestTopicConfig(t *testing.T) {
+	data := `
+topic = "{schema}.{table}"
+
+[[schema]]
+  name = "db1"
+  tables = ["user", "order"]
+  topic = "db1_{table}"
+
+  [schema.table.order]
+    topic = "orders_{action}"
+    shards = 8
+    shard_key = "user_id"
+
+  [schema.table.user]
+    route_column = "tenant_id"
+    default_topic = "user_other"
+
+    [schema.table.user.topic_map]
+      "1" = "user_acme"
+`
+	var config Config
+	_, err := toml.Decode(data, &config)
+	assert.Nil(t, err)
+	assert.Equal(t, "{schema}.{table}", config.Topic)
+	assert.Equal(t, "db1_{table}", config.Schemas[0].Topic)
+	assert.Equal(t, "orders_{action}", config.Schemas[0].TableConfigs["order"].Topic)
+	assert.Equal(t, 8, config.Schemas[0].TableConfigs["order"].Shards)
+	assert.Equal(t, "user_id", config.Schemas[0].TableConfigs["order"].ShardKey)
+	assert.Equal(t, "tenant_id", config.Schemas[0].TableConfigs["user"].RouteColumn)
+	assert.Equal(t, map[string]string{"1": "user_acme"}, config.Schemas[0].TableConfigs["user"].TopicMap)
+	assert.Equal(t, "user_other", config.Schemas[0].TableConfigs["user"].DefaultTopic)
+}
+
+func TestRouterShards(t *testing.T) {
+	r, err := NewRouter(Config{
+		Topic: "{schema}.{table}",
+		Schemas: []SchemaConfig{{Name: "db1", TableConfigs: map[string]TableConfig{
+			"user":  {Shards: 4},
+			"order": {Shards: 2, ShardKey: "user_id"},
+		}}},
+	}, nil)
+	assert.Nil(t, err)
+
+	dc := &DataChanged{Schema: "db1", Table: "user", Action: INSERT, Source: Source{RowIndex: 3}}
+	for _, key := range []string{"1", "2", "3", "1"} {
+		dc.Changes = append(dc.Changes, RowChange{Key: key})
+	}
+	routed := r.Route(dc)
+
+	// 同一个key总是在同一个topic中，行保持原来的顺序
+	topics := make(map[string]string)
+	var indexes []int
+	for _, rd := range routed {
+		assert.Regexp(t, `^db1\.user\.[0-3]$`, rd.Topic)
+		assert.Equal(t, len(rd.Data.Changes), len(rd.Data.Source.RowIndexes))
+		for i, c := range rd.Data.Changes {
+			if topic, ok := topics[c.Key]; ok {
+				assert.Equal(t, topic, rd.Topic)
+			}
+			topics[c.Key] = rd.Topic
+			indexes = append(indexes, rd.Data.Source.RowIndexes[i])
+			assert.Equal(t, dc.Changes[rd.Data.Source.RowIndexes[i]-3], c)
+		}
+	}
+	assert.Equal(t, 4, len(indexes))
+	assert.Equal(t, r.Route(&DataChanged{Schema: "db1", Table: "user", Changes: []RowChange{{Key: "1"}}})[0].Topic, topics["1"])
+
+	// 没有拆分时不带RowIndexes
+	one := &DataChanged{Schema: "db1", Table: "user", Changes: []RowChange{{Key: "1"}, {Key: "1"}}}
+	routed = r.Route(one)
+	assert.Equal(t, 1, len(routed))
+	assert.True(t, one == routed[0].Data)
+	assert.Nil(t, routed[0].Data.Source.RowIndexes)
+
+	// 按shard_key分片，DELETE取Before，UPDATE的After中没有时取Before
+	insert := r.Route(&DataChanged{Schema: "db1", Table: "order", Changes: []RowChange{{After: map[string]interface{}{"user_id": 7}}}})
+	del := r.Route(&DataChanged{Schema: "db1", Table: "order", Changes: []RowChange{{Before: map[string]interface{}{"user_id": 7}}}})
+	update := r.Route(&DataChanged{Schema: "db1", Table: "order", Changes: []RowChange{{
+		Before: map[string]interface{}{"user_id": 7},
+		After:  map[string]interface{}{"amount": 1},
+	}}})
+	assert.Equal(t, insert[0].Topic, del[0].Topic)
+	assert.Equal(t, insert[0].Topic, update[0].Topic)
+
+	// 没有分片的表不变
+	assert.Equal(t, "db1.log", r.Route(&DataChanged{Schema: "db1", Table: "log"})[0].Topic)
+
+	_, err = NewRouter(Config{Schemas: []SchemaConfig{{Name: "db1", TableConfigs: map[string]TableConfig{"user": {Shards: -1}}}}}, nil)
+	assert.NotNil(t, err)
+
+	// 加上分片后超长被截断，分片之间冲突
+	_, err = NewRouter(Config{Schemas: []SchemaConfig{{Name: strings.Repeat("d", 64), TableConfigs: map[string]TableConfig{"user": {Shards: 2}}}}}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestRouterShardKeyChange(t *testing.T) {
+	r, err := NewRouter(Config{
+		Topic: "{schema}.{table}",
+		Schemas: []SchemaConfig{{Name: "db1", TableConfigs: map[string]TableConfig{
+			"user":  {Shards: 4},
+			"order": {Shards: 4, ShardKey: "user_id"},
+		}}},
+	}, nil)
+	assert.Nil(t, err)
+
+	// 找到两个不在同一个分片的key
+	rule := r.rules[TableRef{Schema: "db1", Table: "user"}]
+	oldKey, newKey := "1", "2"
+	for shardOfKey(rule, oldKey) == shardOfKey(rule, newKey) {
+		newKey += "0"
+	}
+	oldTopic := r.Topic(&DataChanged{Schema: "db1", Table: "user", Changes: []RowChange{{Key: oldKey}}})
+	newTopic := r.Topic(&DataChanged{Schema: "db1", Table: "user", Changes: []RowChange{{Key: newKey}}})
+
+	// 修改主键的UPDATE同时发往原来的分片，先发往原来的分片
+	change := RowChange{Key: newKey, OldKey: oldKey}
+	routed := r.Route(&DataChanged{Schema: "db1", Table: "user", Action: UPDATE, Changes: []RowChange{change}})
+	assert.Equal(t, 2, len(routed))
+	assert.Equal(t, oldTopic, routed[0].Topic)
+	assert.Equal(t, newTopic, routed[1].Topic)
+	assert.Equal(t, []RowChange{change}, routed[0].Data.Changes)
+	assert.Equal(t, []RowChange{change}, routed[1].Data.Changes)
+
+	// 主键没变或者在同一个分片时只发一次
+	assert.Equal(t, 1, len(r.Route(&DataChanged{Schema: "db1", Table: "user", Action: UPDATE, Changes: []RowChange{{Key: newKey}}})))
+	assert.Equal(t, 1, len(r.Route(&DataChanged{Schema: "db1", Table: "user", Action: UPDATE, Changes: []RowChange{{Key: oldKey, OldKey: oldKey}}})))
+
+	// 修改shard_key
+	routed = r.Route(&DataChanged{Schema: "db1", Table: "order", Action: UPDATE, Changes: []RowChange{{
+		Before: map[string]interface{}{"user_id": oldKey},
+		After:  map[string]interface{}{"user_id": newKey},
+	}}})
+	assert.Equal(t, []string{"db1.order." + oldTopic[len("db1.user."):], "db1.order." + newTopic[len("db1.user."):]},
+		[]string{routed[0].Topic, routed[1].Topic})
+
+	// Before中没有shard_key时不知道原来的分片
+	assert.Equal(t, 1, len(r.Route(&DataChanged{Schema: "db1", Table: "order", Action: UPDATE, Changes: []RowChange{{
+		Before: map[string]interface{}{"id": 1},
+		After:  map[string]interface{}{"user_id": newKey},
+	}}})))
+}
+
+func TestRouterRowValue(t *testing.T) {
+	r, err := NewRouter(Config{
+		Schemas: []SchemaConfig{{Name: "db1", TableConfigs: map[string]TableConfig{
+			"orders": {Topic: "orders_{row.tenant_id}"},
+			"users": {
+				RouteColumn:  "tenant_id",
+				TopicMap:     map[string]string{"1": "acme_{table}", "2": "globex_{table}"},
+				DefaultTopic: "other_{table}",
+			},
+		}}},
+	}, nil)
+	assert.Nil(t, err)
+
+	row := func(tenantID interface{}, id int) RowChange {
+		return RowChange{After: map[string]interface{}{"tenant_id": tenantID, "id": id}}
+	}
+
+	dc := &DataChanged{Schema: "db1", Table: "orders", Action: INSERT, Changes: []RowChange{row(1, 1), row(2, 2), row(1, 3)}}
+	routed := r.Route(dc)
+	assert.Equal(t, 2, len(routed))
+	assert.Equal(t, "orders_1", routed[0].Topic)
+	assert.Equal(t, []RowChange{row(1, 1), row(1, 3)}, routed[0].Data.Changes)
+	assert.Equal(t, []int{0, 2}, routed[0].Data.Source.RowIndexes)
+	assert.Equal(t, "orders_2", routed[1].Topic)
+	assert.Equal(t, []int{1}, routed[1].Data.Source.RowIndexes)
+
+	// DELETE取Before
+	assert.Equal(t, "orders_3", r.Topic(&DataChanged{Schema: "db1", Table: "orders", Action: DELETE,
+		Changes: []RowChange{{Before: map[string]interface{}{"tenant_id": 3}}}}))
+
+	dc = &DataChanged{Schema: "db1", Table: "users", Action: UPDATE, Changes: []RowChange{row(2, 1), row(9, 2), row("1", 3)}}
+	var topics []string
+	for _, rd := range r.Route(dc) {
+		topics = append(topics, rd.Topic)
+	}
+	assert.Equal(t, []string{"globex_users", "other_users", "acme_users"}, topics)
+
+	_, err = NewRouter(Config{Topic: "{row.}"}, nil)
+	assert.NotNil(t, err)
+	_, err = NewRouter(Config{Schemas: []SchemaConfig{{Name: "db1", TableConfigs: map[string]TableConfig{"users": {RouteColumn: "tenant_id"}}}}}, nil)
+	assert.NotNil(t, err)
+	_, err = NewRouter(Config{Schemas: []SchemaConfig{{Name: "db1", TableConfigs: map[string]TableConfig{"users": {TopicMap: map[string]string{"1": "acme"}}}}}}, nil)
+	assert.NotNil(t, err)
+
+	// topic_map中的topic也检查冲突
+	_, err = NewRouter(Config{Schemas: []SchemaConfig{{Name: "db1", TableConfigs: map[string]TableConfig{
+		"users": {RouteColumn: "tenant_id", TopicMap: map[string]string{"1": "acme$", "2": "acme_"}},
+	}}}}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestRouterEmptyRowTopic(t *testing.T) {
+	r, err := NewRouter(Config{
+		Schemas: []SchemaConfig{{Name: "db1", TableConfigs: map[string]TableConfig{
+			"events": {Topic: "{row.tenant_id}"},
+			"users": {
+				RouteColumn:  "tenant_id",
+				TopicMap:     map[string]string{"1": "{row.region}"},
+				DefaultTopic: "other_{table}",
+			},
+		}}},
+	}, nil)
+	assert.Nil(t, err)
+
+	fallbacks := metricTopicFallbacks.Value()
+	topic := func(table string, after map[string]interface{}) string {
+		return r.Topic(&DataChanged{Schema: "db1", Table: table, Action: INSERT, Changes: []RowChange{{After: after}}})
+	}
+
+	// 字段的值是NULL、空字符串或者没有该字段时topic为空，没有default_topic并且表的模板也用到了行的字段，使用DefaultTopic
+	assert.Equal(t, "db1", topic("events", map[string]interface{}{"tenant_id": nil}))
+	assert.Equal(t, "db1", topic("events", map[string]interface{}{"tenant_id": ""}))
+	assert.Equal(t, "db1", topic("events", map[string]interface{}{"id": 1}))
+	assert.Equal(t, "7", topic("events", map[string]interface{}{"tenant_id": 7}))
+
+	// 有default_topic时使用default_topic
+	assert.Equal(t, "other_users", topic("users", map[string]interface{}{"tenant_id": 1, "region": nil}))
+	assert.Equal(t, "eu", topic("users", map[string]interface{}{"tenant_id": 1, "region": "eu"}))
+
+	assert.Equal(t, fallbacks+4, metricTopicFallbacks.Value())
+}
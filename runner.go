@@ -0,0 +1,890 @@
+package mysql2nsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// Runner 从mysql同步binlog，把数据变化发布出去
+//
+// Run 会一直运行，直到ctx被取消或者出现无法继续的错误
+type Runner struct {
+	// config 只在同步的goroutine中修改，修改时和其他goroutine读取时需持有lock
+	config  Config
+	tmm     *TableMetaManager
+	storage GTIDSetStorage
+	// positions 不为nil时使用binlog文件名和位置同步，不使用storage
+	positions PositionStorage
+	sink      Sink
+	// router 决定消息的topic，Run 开始时根据配置构造
+	router *Router
+	// snapshotter 不为nil时，Run 先完成快照再同步binlog
+	snapshotter *Snapshotter
+	// incremental 不为nil时可以在同步binlog的同时做增量快照
+	incremental *IncrementalSnapshotter
+
+	lock   sync.Mutex
+	syncer *replication.BinlogSyncer
+	// closed 表示调用了 Close，cancel 停止正在运行的 Run，由lock保护
+	closed bool
+	cancel context.CancelFunc
+	// connect 开始同步binlog，为nil时连接mysql，测试时替换
+	connect func(GTIDSet mysql.GTIDSet) (eventStreamer, error)
+	// connectPosition 从binlog位置开始同步，为nil时连接mysql，测试时替换
+	connectPosition func(pos mysql.Position) (eventStreamer, error)
+
+	// txnGTID 是当前事务的GTID，事务提交（XID或COMMIT）时才更新GTIDSet，保证至少一次投递
+	// 事务中有数据发布失败时返回streamError，从storage记录的位置重新同步，之后的事务不会越过该事务提交
+	txnGTID string
+
+	// position 是已经读到的binlog位置，包含当前事务，用于查找事件发生时的表结构
+	position mysql.GTIDSet
+
+	// logName 是当前binlog文件名，txnRowIndex 是当前事务中下一行的下标
+	logName     string
+	txnRowIndex int
+
+	// status 是运行状态，由lock保护
+	status Status
+	// lastProgress 是同步的循环最近一次有进展的时间，由lock保护
+	lastProgress time.Time
+	// resumed 在暂停时不为nil，恢复时关闭，由lock保护
+	resumed chan struct{}
+	// reloaded 是 Reload 传入的新配置，在处理两个事件之间应用，由lock保护
+	reloaded *reloadedConfig
+	// schemaReloaded 表示重新读取了表结构，在处理两个事件之间记录到表结构历史，由lock保护
+	schemaReloaded bool
+
+	// checksum 表示binlog事件末尾是否带有CRC32校验码
+	checksum bool
+	// tableMaps 是从TableMapEvent的可选元数据得到的表结构，优先于information_schema使用
+	tableMaps map[TableRef]*Table
+}
+
+// NewRunner 返回Runner实例
+func NewRunner(config Config, tmm *TableMetaManager, storage GTIDSetStorage, sink Sink) *Runner {
+	return &Runner{
+		config:       config,
+		tmm:          tmm,
+		storage:      storage,
+		sink:         sink,
+		router:       &Router{},
+		tableMaps:    make(map[TableRef]*Table),
+		lastProgress: time.Now(),
+	}
+}
+
+// Run 从storage记录的GTIDSet开始同步binlog
+// binlog连接断开时按配置重连，重连时从storage中最新的GTIDSet重新开始
+// ctx被取消或者调用了 Close 时返回nil，其他情况返回导致同步停止的错误
+func (r *Runner) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r.lock.Lock()
+	closed := r.closed
+	r.cancel = cancel
+	r.lock.Unlock()
+	if closed {
+		return nil
+	}
+
+	if err := r.buildRouter(); err != nil {
+		return err
+	}
+
+	if err := r.snapshot(ctx); err != nil {
+		if ctx.Err() != nil {
+			log.Infof("Context done, stop snapshot\n")
+			return nil
+		}
+		return fmt.Errorf("快照失败: %s", err)
+	}
+
+	var backoff *Backoff
+	var disconnectedAt time.Time
+
+	for {
+		streamed, err := r.sync(ctx)
+		if ctx.Err() != nil {
+			log.Infof("Context done, stop syncing\n")
+			return nil
+		}
+
+		if _, ok := err.(*streamError); !ok {
+			return err
+		}
+
+		// 收到过事件说明连接恢复过，重新计算重连次数
+		if streamed || backoff == nil {
+			backoff = NewBackoff(r.config.Reconnect.backoffConfig())
+			disconnectedAt = time.Now()
+		}
+
+		wait, ok := backoff.Next()
+		giveUpAfter := r.config.Reconnect.GiveUpAfter.Duration
+		if !ok || (giveUpAfter > 0 && time.Since(disconnectedAt) > giveUpAfter) {
+			return fmt.Errorf("断开%s，重连%d次后放弃: %s", time.Since(disconnectedAt), backoff.Attempts()-1, err)
+		}
+
+		metricBinlogReconnects.Inc()
+		log.Warnf("%s，%s后重连（第%d次）\n", err, wait, backoff.Attempts())
+		r.touch()
+
+		select {
+		case <-ctx.Done():
+			log.Infof("Context done, stop syncing\n")
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// buildRouter 根据配置构造router
+func (r *Runner) buildRouter() error {
+	router, err := NewRouter(r.config, r.tmm.Tables())
+	if err != nil {
+		return fmt.Errorf("topic配置错误: %s", err)
+	}
+	r.router = router
+	return nil
+}
+
+// streamError 是可以通过重连，从storage记录的位置重新同步恢复的错误，例如binlog连接断开或者发布失败
+type streamError struct {
+	err error
+}
+
+func (e *streamError) Error() string {
+	return e.err.Error()
+}
+
+// eventStreamer 是binlog事件流，replication.BinlogStreamer 实现了该接口
+type eventStreamer interface {
+	GetEvent(ctx context.Context) (*replication.BinlogEvent, error)
+}
+
+// sync 从storage中的GTIDSet开始同步一次，直到出错或者ctx被取消
+// streamed 表示是否收到过事件
+func (r *Runner) sync(ctx context.Context) (streamed bool, err error) {
+	defer r.closeSyncer()
+	streamer, err := r.start()
+	if err != nil {
+		return false, err
+	}
+
+	r.setConnected(true)
+	defer r.setConnected(false)
+
+	// lastReceived 是最近一次收到事件（包括心跳）的时间
+	lastReceived := time.Now()
+	streamTimeout := r.config.Health.streamTimeout()
+	pollInterval := 2 * time.Second
+	if streamTimeout > 0 && streamTimeout < pollInterval {
+		pollInterval = streamTimeout
+	}
+	for {
+		r.touch()
+		if err := r.applyReloaded(); err != nil {
+			return streamed, err
+		}
+		if r.incremental != nil {
+			r.incremental.step(ctx)
+		}
+
+		c, cancel := context.WithTimeout(ctx, pollInterval)
+		ev, err := streamer.GetEvent(c)
+		cancel()
+
+		if ctx.Err() != nil {
+			return streamed, nil
+		}
+
+		if err != nil {
+			if err == context.DeadlineExceeded {
+				if streamTimeout > 0 && time.Since(lastReceived) > streamTimeout {
+					// 连接可能已经失效了，重新连接
+					metricWatchdogRestarts.Inc()
+					return streamed, &streamError{fmt.Errorf("%s内没有收到事件或心跳", streamTimeout)}
+				}
+				// 超时了，继续等待
+				continue
+			}
+			return streamed, &streamError{fmt.Errorf("get binlog event failed: %s", err)}
+		}
+		streamed = true
+		metricBinlogEvents.With(ev.Header.EventType.String()).Inc()
+
+		// 暂停时不再读取事件
+		r.waitResumed(ctx)
+		if ctx.Err() != nil {
+			return streamed, nil
+		}
+		lastReceived = time.Now()
+		if err = r.applyReloaded(); err != nil {
+			return streamed, err
+		}
+
+		if err = r.handleEvent(ctx, ev); err != nil {
+			return streamed, err
+		}
+	}
+}
+
+// start 从storage中记录的位置开始同步binlog，连接失败时返回streamError
+func (r *Runner) start() (eventStreamer, error) {
+	if r.positions != nil {
+		return r.startPosition()
+	}
+
+	// 读取已经同步过的binlog GTIDSet
+	GTIDSet, err := r.storage.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read GTIDSet failed: %s", err)
+	}
+	r.reset(GTIDSet)
+
+	if err = r.tmm.BootstrapSchemaHistory(GTIDSet); err != nil {
+		return nil, fmt.Errorf("bootstrap schema history failed: %s", err)
+	}
+
+	connect := r.connect
+	if connect == nil {
+		connect = r.connectMySQL
+	}
+	streamer, err := connect(GTIDSet)
+	if err != nil {
+		return nil, &streamError{fmt.Errorf("start sync failed: %s", err)}
+	}
+
+	log.Infof("Start syncing from GTIDSet: %s\n", GTIDSet)
+	return streamer, nil
+}
+
+// startPosition 从positions中记录的binlog位置开始同步
+// 表结构历史按GTIDSet记录，position模式下不使用，总是使用当前的表结构
+func (r *Runner) startPosition() (eventStreamer, error) {
+	pos, err := r.positions.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read binlog position failed: %s", err)
+	}
+	r.reset(nil)
+	r.logName = pos.Name
+
+	connect := r.connectPosition
+	if connect == nil {
+		connect = r.connectMySQLPosition
+	}
+	streamer, err := connect(pos)
+	if err != nil {
+		return nil, &streamError{fmt.Errorf("start sync failed: %s", err)}
+	}
+
+	log.Infof("Start syncing from position: %s\n", FormatPosition(pos))
+	return streamer, nil
+}
+
+// connectMySQL 连接mysql，从GTIDSet之后开始同步
+func (r *Runner) connectMySQL(GTIDSet mysql.GTIDSet) (eventStreamer, error) {
+	return r.newSyncer().StartSyncGTID(GTIDSet)
+}
+
+// connectMySQLPosition 连接mysql，从binlog位置开始同步
+func (r *Runner) connectMySQLPosition(pos mysql.Position) (eventStreamer, error) {
+	return r.newSyncer().StartSync(pos)
+}
+
+// newSyncer 创建连接mysql的BinlogSyncer
+func (r *Runner) newSyncer() *replication.BinlogSyncer {
+	// Create a binlog syncer with a unique server id, the server id must be different from other MySQL's.
+	// flavor is mysql or mariadb
+	cfg := replication.BinlogSyncerConfig{
+		ServerID: r.config.Mysql.ServerID,
+		Flavor:   "mysql",
+		Host:     r.config.Mysql.Host,
+		Port:     r.config.Mysql.Port,
+		User:     r.config.Mysql.User,
+		Password: r.config.Mysql.Password,
+		// mysql在没有新事件时按该间隔发送心跳，用来发现失效的连接
+		HeartbeatPeriod: r.config.Health.HeartbeatPeriod.Duration,
+		// 断开时不让go-mysql自己重连，错误交给Run按reconnect配置重连，并从storage记录的位置重新开始
+		DisableRetrySync: true,
+	}
+	syncer := replication.NewBinlogSyncer(cfg)
+
+	r.lock.Lock()
+	r.syncer = syncer
+	r.lock.Unlock()
+
+	return syncer
+}
+
+// reset 丢弃没有提交的事务，从GTIDSet重新开始，position模式下GTIDSet为nil
+func (r *Runner) reset(GTIDSet mysql.GTIDSet) {
+	r.position = nil
+	if GTIDSet != nil {
+		r.position = GTIDSet.Clone()
+	}
+	r.txnGTID = ""
+	r.txnRowIndex = 0
+	r.logName = ""
+	r.tableMaps = make(map[TableRef]*Table)
+	if r.incremental != nil {
+		r.incremental.reset()
+	}
+}
+
+// Close 停止同步，Run 不再重连，返回nil
+func (r *Runner) Close() error {
+	r.lock.Lock()
+	r.closed = true
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.lock.Unlock()
+
+	r.closeSyncer()
+	return nil
+}
+
+// closeSyncer 关闭当前的binlog连接
+func (r *Runner) closeSyncer() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.syncer != nil {
+		r.syncer.Close()
+		r.syncer = nil
+	}
+}
+
+func (r *Runner) handleEvent(ctx context.Context, ev *replication.BinlogEvent) error {
+	switch ev.Event.(type) {
+	case *replication.GTIDEvent, *replication.RowsEvent, *replication.XIDEvent, *replication.QueryEvent:
+		// 其他事件的时间可能是binlog文件创建的时间，或者为0
+		if ev.Header.Timestamp > 0 {
+			r.observeEvent(time.Unix(int64(ev.Header.Timestamp), 0))
+		}
+	}
+
+	switch e := ev.Event.(type) {
+	case *replication.RotateEvent:
+		r.logName = string(e.NextLogName)
+		// 连接时mysql发送的RotateEvent的LogPos为0，只是告诉开始的位置
+		if r.positions != nil && ev.Header.LogPos > 0 {
+			return r.commitPosition(ctx, mysql.Position{Name: r.logName, Pos: uint32(e.Position)})
+		}
+	case *replication.FormatDescriptionEvent:
+		r.checksum = e.ChecksumAlgorithm == replication.BINLOG_CHECKSUM_ALG_CRC32
+	case *replication.TableMapEvent:
+		r.handleTableMap(ev, e)
+	case *replication.GTIDEvent:
+		// 记下事务的GTID，等事务提交时再更新GTIDSet
+		u, _ := uuid.FromBytes(e.SID)
+		r.txnGTID = fmt.Sprintf("%s:%d", u.String(), e.GNO)
+		r.txnRowIndex = 0
+		if r.position != nil {
+			if err := r.position.Update(r.txnGTID); err != nil {
+				return fmt.Errorf("update position failed %s: %s", r.txnGTID, err)
+			}
+		}
+	case *replication.RowsEvent:
+		if r.incremental != nil && r.incremental.isSignal(string(e.Table.Schema), string(e.Table.Table)) {
+			// 看到高水位时发布增量快照的一块
+			if dc := r.incremental.handleSignal(ev, e); dc != nil {
+				if err := r.publishData(ctx, dc); err != nil {
+					return &streamError{fmt.Errorf("发布增量快照失败，从上次提交的位置重新同步: %s", err)}
+				}
+			}
+		} else if err := r.publish(ctx, ev); err != nil {
+			// 发送新增、删除、修改数据
+			return err
+		}
+		// 不在配置中的表的行也计数，这样行的下标不受配置影响
+		if ev.Header.EventType == replication.UPDATE_ROWS_EVENTv2 {
+			r.txnRowIndex += len(e.Rows) / 2
+		} else {
+			r.txnRowIndex += len(e.Rows)
+		}
+	case *replication.XIDEvent:
+		return r.commit(ctx, ev)
+	case *replication.QueryEvent:
+		// DDL和非事务引擎的事务以QueryEvent结束，BEGIN除外
+		query := string(e.Query)
+		if query == "BEGIN" {
+			// position模式下没有GTIDEvent，事务从BEGIN开始
+			r.txnRowIndex = 0
+			break
+		}
+		if query != "COMMIT" {
+			// 表结构可能变化了，读取失败时不提交，重启后会重新处理该DDL
+			if err := r.tmm.HandleDDL(string(e.Schema), query, r.position); err != nil {
+				return fmt.Errorf("DDL后重新读取表结构失败 %s: %s", query, err)
+			}
+		}
+		return r.commit(ctx, ev)
+	}
+
+	return nil
+}
+
+// publish 转换并发布RowsEvent
+// 转换失败时重新同步也会失败，返回导致同步停止的错误；发布失败时返回streamError，从上次提交的位置重新同步
+func (r *Runner) publish(ctx context.Context, ev *replication.BinlogEvent) error {
+	dc, err := NewDataChangedFromBinlogEvent(ev, r.tables())
+	if err != nil {
+		if err == ErrNotFound {
+			metricConversionErrors.With("not_found").Inc()
+			log.Debugf("转换DataChanged时没知道表定义")
+			return nil
+		}
+		metricConversionErrors.With("other").Inc()
+		return fmt.Errorf("转换成DataChanged出错了 %s: %s", r.txnGTID, err)
+	}
+
+	dc.Source = Source{
+		ServerID:  ev.Header.ServerID,
+		GTID:      r.txnGTID,
+		File:      r.logName,
+		Pos:       ev.Header.LogPos,
+		Timestamp: time.Unix(int64(ev.Header.Timestamp), 0),
+		RowIndex:  r.txnRowIndex,
+	}
+	if r.incremental != nil {
+		r.incremental.observe(dc)
+	}
+	if err = r.publishData(ctx, dc); err != nil {
+		return &streamError{fmt.Errorf("%s，从上次提交的位置重新同步", err)}
+	}
+	return nil
+}
+
+// publishData 按topic拆分dc并发布，失败时按配置重试
+// 每次尝试前设置PublishedAt并重新序列化，消息中是最后一次尝试的时间
+func (r *Runner) publishData(ctx context.Context, dc *DataChanged) error {
+	for _, routed := range r.router.Route(dc) {
+		log.Debugf("准备发送数据: %s %+v\n", routed.Topic, routed.Data)
+
+		var encodeErr error
+		err := r.retry(ctx, func() error {
+			routed.Data.PublishedAt = time.Now()
+			var bs []byte
+			if bs, encodeErr = routed.Data.EncodeAs(r.config.MessageFormat); encodeErr != nil {
+				// 序列化失败重试也没有用
+				return nil
+			}
+			return r.sink.Publish(&Message{Topic: routed.Topic, Body: bs, Data: routed.Data})
+		})
+		if encodeErr != nil {
+			return fmt.Errorf("序列化DataChanged失败: %s", encodeErr)
+		}
+		if err != nil {
+			return fmt.Errorf("发布失败：%s", err)
+		}
+	}
+
+	// 修改了分片key的UPDATE会发往两个分片，按拆分前的行数统计，每行只算一次
+	metricRowsPublished.With(dc.Schema, dc.Table, string(dc.Action)).Add(float64(len(dc.Changes)))
+	return nil
+}
+
+// SetSnapshotter 设置初始快照，Run 开始时如果快照还没有完成，先完成快照
+func (r *Runner) SetSnapshotter(snapshotter *Snapshotter) {
+	r.snapshotter = snapshotter
+}
+
+// SetPositionStorage 设置记录binlog文件名和位置的PositionStorage，设置后使用position模式同步
+func (r *Runner) SetPositionStorage(positions PositionStorage) {
+	r.positions = positions
+}
+
+// SetIncrementalSnapshotter 设置增量快照
+func (r *Runner) SetIncrementalSnapshotter(incremental *IncrementalSnapshotter) {
+	r.incremental = incremental
+}
+
+// SnapshotTable 请求在同步binlog的同时对表做增量快照
+func (r *Runner) SnapshotTable(schemaName, tableName string) error {
+	if r.incremental == nil {
+		return errors.New("没有配置snapshot.signal_table，不能做增量快照")
+	}
+	return r.incremental.Request(schemaName, tableName)
+}
+
+// snapshot 发布快照数据，完成后把快照时的GTIDSet写入storage，之后从该位置同步binlog
+func (r *Runner) snapshot(ctx context.Context) error {
+	if r.snapshotter == nil || r.snapshotter.Done() {
+		return nil
+	}
+
+	GTIDSet, err := r.snapshotter.Run(ctx, func(dc *DataChanged) error {
+		r.waitResumed(ctx)
+		r.touch()
+		if err := r.publishData(ctx, dc); err != nil {
+			return err
+		}
+		// 数据确认发布后才记录进度
+		return r.retry(ctx, r.sink.Flush)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Update 每次只接受一个server_uuid的GTID区间
+	for _, set := range GTIDSet.(*mysql.MysqlGTIDSet).Sets {
+		if err = r.storage.Update(set.String()); err != nil {
+			return fmt.Errorf("update GTIDSet failed: %s", err)
+		}
+	}
+	log.Infof("快照完成，从GTIDSet %s 开始同步binlog\n", GTIDSet)
+	return r.snapshotter.Finish()
+}
+
+// handleTableMap 记录TableMapEvent中带的表结构，没有字段名时使用TableMetaManager中的表结构
+func (r *Runner) handleTableMap(ev *replication.BinlogEvent, e *replication.TableMapEvent) {
+	ref := TableRef{Schema: string(e.Schema), Table: string(e.Table)}
+	if !r.tmm.Includes(ref.Schema, ref.Table) {
+		return
+	}
+
+	table, err := TableFromTableMapEvent(ev, r.checksum)
+	if err != nil {
+		log.Warnf("解析TableMapEvent元数据失败 %s.%s: %s\n", ref.Schema, ref.Table, err)
+	}
+
+	if table == nil {
+		delete(r.tableMaps, ref)
+		return
+	}
+	r.tableMaps[ref] = table
+}
+
+// tables 返回当前binlog位置的表结构
+func (r *Runner) tables() TableQuerier {
+	var fallback TableQuerier = r.tmm
+	if r.position != nil {
+		fallback = r.tmm.At(r.position)
+	}
+	return binlogTables{tmm: r.tmm, tables: r.tableMaps, fallback: fallback}
+}
+
+// binlogTables 优先使用TableMapEvent中的表结构，没有时使用fallback
+type binlogTables struct {
+	tmm      *TableMetaManager
+	tables   map[TableRef]*Table
+	fallback TableQuerier
+}
+
+func (t binlogTables) Query(schemaName, tableName string) (*Table, error) {
+	if !t.tmm.Includes(schemaName, tableName) {
+		return nil, ErrNotFound
+	}
+
+	if tbl, ok := t.tables[TableRef{Schema: schemaName, Table: tableName}]; ok {
+		return tbl, nil
+	}
+
+	return t.fallback.Query(schemaName, tableName)
+}
+
+// commit 在事务结束时更新GTIDSet
+// Flush失败时不更新GTIDSet，返回streamError，从上次提交的位置重新同步
+func (r *Runner) commit(ctx context.Context, ev *replication.BinlogEvent) error {
+	if r.positions != nil {
+		return r.commitPosition(ctx, mysql.Position{Name: r.logName, Pos: ev.Header.LogPos})
+	}
+
+	GTID := r.txnGTID
+	r.txnGTID = ""
+
+	if GTID == "" {
+		return nil
+	}
+
+	if err := r.retry(ctx, r.sink.Flush); err != nil {
+		return &streamError{fmt.Errorf("Flush失败，不更新GTID %s，从上次提交的位置重新同步: %s", GTID, err)}
+	}
+
+	if err := r.storage.Update(GTID); err != nil {
+		return fmt.Errorf("更新GTID失败 %s: %s", GTID, err)
+	}
+
+	return nil
+}
+
+// commitPosition 在position模式下事务结束或者切换binlog文件时更新位置，pos是下一个事件的位置
+// 位置不能跳过没有发布成功的事务，Flush失败时返回streamError，马上从上次记录的位置重新同步
+func (r *Runner) commitPosition(ctx context.Context, pos mysql.Position) error {
+	if err := r.retry(ctx, r.sink.Flush); err != nil {
+		return &streamError{fmt.Errorf("Flush失败，不更新binlog位置 %s，从上次记录的位置重新同步: %s", FormatPosition(pos), err)}
+	}
+
+	if err := r.positions.Update(pos); err != nil {
+		return fmt.Errorf("更新binlog位置失败 %s: %s", FormatPosition(pos), err)
+	}
+
+	return nil
+}
+
+// retry 按配置重试fn，直到成功、达到最大尝试次数或者ctx被取消
+// 重试期间不会读取新的binlog事件，读取binlog的速度受发布速度的限制
+// 放弃时返回错误，调用方从上次提交的位置重新同步，不能继续处理之后的事件
+func (r *Runner) retry(ctx context.Context, fn func() error) error {
+	var backoff *Backoff
+	var stalledAt time.Time
+
+	for {
+		err := fn()
+		if err != nil {
+			metricPublishFailures.Inc()
+		}
+		if err == nil || ctx.Err() != nil {
+			if backoff != nil {
+				metricPublishStalled.Set(0)
+				metricPublishStallSeconds.Add(time.Since(stalledAt).Seconds())
+				if err == nil {
+					log.Infof("重试%d次后恢复，暂停了%s\n", backoff.Attempts(), time.Since(stalledAt))
+				}
+			}
+			return err
+		}
+
+		if backoff == nil {
+			backoff = NewBackoff(r.config.Retry)
+			stalledAt = time.Now()
+		}
+
+		r.touch()
+		wait, ok := backoff.Next()
+		if !ok {
+			metricPublishStalled.Set(0)
+			metricPublishStallSeconds.Add(time.Since(stalledAt).Seconds())
+			return fmt.Errorf("尝试%d次后放弃: %s", backoff.Attempts(), err)
+		}
+
+		if backoff.Attempts() == 1 {
+			metricPublishStalls.Inc()
+			metricPublishStalled.Set(1)
+		}
+		metricPublishRetries.Inc()
+		log.Warnf("发布失败，%s后重试（第%d次）: %s\n", wait, backoff.Attempts(), err)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Status 是Runner的运行状态
+type Status struct {
+	// Connected 表示是否连接着mysql
+	Connected bool
+	// Paused 表示是否暂停了发布
+	Paused bool
+	// LastEventTime 是最近一个事件在mysql中发生的时间，LastEventReadAt 是读到它的时间
+	LastEventTime   time.Time
+	LastEventReadAt time.Time
+	// Lag 是读到最近一个事件时的复制延迟，单位秒
+	Lag float64
+}
+
+// Status 返回当前的运行状态
+func (r *Runner) Status() Status {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	status := r.status
+	status.Paused = r.resumed != nil
+	return status
+}
+
+func (r *Runner) setConnected(connected bool) {
+	r.lock.Lock()
+	r.status.Connected = connected
+	r.lock.Unlock()
+
+	if connected {
+		metricBinlogConnected.Set(1)
+	} else {
+		metricBinlogConnected.Set(0)
+	}
+}
+
+func (r *Runner) observeEvent(eventTime time.Time) {
+	now := time.Now()
+	lag := now.Sub(eventTime).Seconds()
+	metricReplicationLag.Set(lag)
+
+	r.lock.Lock()
+	r.status.LastEventTime = eventTime
+	r.status.LastEventReadAt = now
+	r.status.Lag = lag
+	r.lock.Unlock()
+}
+
+// Pause 暂停发布，暂停期间不读取binlog，也不更新GTIDSet
+func (r *Runner) Pause() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.resumed == nil {
+		r.resumed = make(chan struct{})
+		log.Infof("暂停发布\n")
+	}
+}
+
+// Resume 恢复发布
+func (r *Runner) Resume() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.resumed != nil {
+		close(r.resumed)
+		r.resumed = nil
+		log.Infof("恢复发布\n")
+	}
+}
+
+// waitResumed 暂停时等待恢复或者ctx被取消
+func (r *Runner) waitResumed(ctx context.Context) {
+	r.lock.Lock()
+	resumed := r.resumed
+	r.lock.Unlock()
+
+	if resumed == nil {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-resumed:
+	}
+}
+
+// touch 记录同步的循环有进展
+func (r *Runner) touch() {
+	r.lock.Lock()
+	r.lastProgress = time.Now()
+	r.lock.Unlock()
+}
+
+// Live 检查同步的循环是否卡住了
+// 等待事件、重试发布和重连都算有进展，暂停时总是返回nil
+func (r *Runner) Live() error {
+	r.lock.Lock()
+	paused := r.resumed != nil
+	lastProgress := r.lastProgress
+	timeout := r.config.Health.livenessTimeout()
+	r.lock.Unlock()
+
+	if paused {
+		return nil
+	}
+
+	if since := time.Since(lastProgress); since > timeout {
+		return fmt.Errorf("已经%s没有进展", since)
+	}
+	return nil
+}
+
+// Ready 检查是否连接着mysql，并且sink可用
+func (r *Runner) Ready() error {
+	if !r.Status().Connected {
+		return errors.New("没有连接mysql")
+	}
+
+	if p, ok := r.sink.(Pinger); ok {
+		if err := p.Ping(); err != nil {
+			return fmt.Errorf("sink不可用: %s", err)
+		}
+	}
+	return nil
+}
+
+// Reload 应用新的配置，不影响同步的位置
+// 同步的库和表、sink的路由立即生效，其他可以在运行时修改的配置在处理下一个事件前生效
+// 不能在运行时修改的配置（见 NonLiveChanges）会被忽略
+func (r *Runner) Reload(config Config) error {
+	if err := r.tmm.SetSchemaConfigs(config.Schemas); err != nil {
+		return fmt.Errorf("重新读取表结构失败: %s", err)
+	}
+	r.setSchemaReloaded()
+
+	router, err := NewRouter(config, r.tmm.Tables())
+	if err != nil {
+		return fmt.Errorf("topic配置错误: %s", err)
+	}
+
+	if reloader, ok := r.sink.(Reloader); ok {
+		if err := reloader.Reload(config); err != nil {
+			return fmt.Errorf("重新加载sink失败: %s", err)
+		}
+	}
+
+	r.lock.Lock()
+	r.reloaded = &reloadedConfig{config: config, router: router}
+	r.lock.Unlock()
+
+	return nil
+}
+
+// ReloadTables 重新读取所有表结构
+// 和DDL一样，新的表结构在处理下一个事件前作为当前binlog位置的版本记录到表结构历史中
+func (r *Runner) ReloadTables() error {
+	if err := r.tmm.Reload(); err != nil {
+		return err
+	}
+	r.setSchemaReloaded()
+	return nil
+}
+
+func (r *Runner) setSchemaReloaded() {
+	r.lock.Lock()
+	r.schemaReloaded = true
+	r.lock.Unlock()
+}
+
+type reloadedConfig struct {
+	config Config
+	router *Router
+}
+
+// applyReloaded 应用 Reload 传入的配置，记录重新读取的表结构，只在同步的goroutine中调用
+// 表结构历史写入失败时返回错误，和DDL一样停止同步
+func (r *Runner) applyReloaded() error {
+	r.lock.Lock()
+	reloaded, schemaReloaded := r.reloaded, r.schemaReloaded
+	r.reloaded, r.schemaReloaded = nil, false
+	r.lock.Unlock()
+
+	if schemaReloaded {
+		if err := r.tmm.RecordSchemaHistory(r.position); err != nil {
+			return fmt.Errorf("记录重新读取的表结构失败: %s", err)
+		}
+	}
+	if reloaded == nil {
+		return nil
+	}
+
+	config := reloaded.config
+	// 不能在运行时修改的配置保持不变
+	config.Mysql = r.config.Mysql
+	config.Storage = r.config.Storage
+	config.TableMetaSource = r.config.TableMetaSource
+	config.Health.HeartbeatPeriod = r.config.Health.HeartbeatPeriod
+	// 其他goroutine（比如 Live）会读取config，持有lock时替换
+	r.lock.Lock()
+	r.config = config
+	r.router = reloaded.router
+	r.lock.Unlock()
+	log.Infof("新的配置已经生效\n")
+	return nil
+}
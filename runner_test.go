@@ -0,0 +1,790 @@
+package mysql2nsq
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/server"
+	"github.com/stretchr/testify/assert"
+)
+
+type memStorage struct {
+	GTIDs []string
+}
+
+func (s *memStorage) Update(GTIDStr string) error {
+	s.GTIDs = append(s.GTIDs, GTIDStr)
+	return nil
+}
+
+func (s *memStorage) Read() (mysql.GTIDSet, error) {
+	set, err := mysql.ParseMysqlGTIDSet("")
+	if err != nil {
+		return nil, err
+	}
+	for _, GTID := range s.GTIDs {
+		if err = set.Update(GTID); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+type memSink struct {
+	err      error
+	flushErr error
+	msgs     []*Message
+}
+
+func (s *memSink) Publish(msg *Message) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.msgs = append(s.msgs, msg)
+	return nil
+}
+
+func (s *memSink) PublishBatch(msgs []*Message) error {
+	for _, msg := range msgs {
+		if err := s.Publish(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memSink) Flush() error {
+	return s.flushErr
+}
+
+func (s *memSink) Close() error {
+	return nil
+}
+
+func (s *memSink) topics() []string {
+	var topics []string
+	for _, msg := range s.msgs {
+		topics = append(topics, msg.Topic)
+	}
+	return topics
+}
+
+func newTestTableMetaManager() *TableMetaManager {
+	return &TableMetaManager{
+		schemaConfigs: []SchemaConfig{{Name: "db1", Tables: []string{"user"}}},
+		schemas: []Schema{
+			{
+				Name: "db1",
+				Tables: []Table{
+					{
+						Name: "user",
+						Columns: []Column{
+							{ColumnName: "id", OrdinalPosition: 1, IsNullable: "NO", DataType: "int"},
+							{ColumnName: "name", OrdinalPosition: 2, IsNullable: "NO", DataType: "varchar"},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func gtidEvent(gno int64) *replication.BinlogEvent {
+	sid := []byte{0x36, 0xc0, 0xfc, 0xec, 0x54, 0x47, 0x11, 0xea, 0x8d, 0xc1, 0x02, 0x42, 0xac, 0x11, 0x00, 0x02}
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.GTID_EVENT},
+		Event:  &replication.GTIDEvent{SID: sid, GNO: gno},
+	}
+}
+
+func rowsEvent(schema, table string, rows ...[]interface{}) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.WRITE_ROWS_EVENTv2},
+		Event: &replication.RowsEvent{
+			Table: &replication.TableMapEvent{Schema: []byte(schema), Table: []byte(table)},
+			Rows:  rows,
+		},
+	}
+}
+
+func xidEvent() *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.XID_EVENT},
+		Event:  &replication.XIDEvent{},
+	}
+}
+
+func TestRunnerCommitAfterPublish(t *testing.T) {
+	storage := &memStorage{}
+	sink := &memSink{}
+	r := NewRunner(Config{}, newTestTableMetaManager(), storage, sink)
+	published := metricRowsPublished.With("db1", "user", "INSERT").Value()
+
+	assert.Nil(t, r.handleEvent(context.Background(), gtidEvent(7)))
+	assert.Nil(t, r.handleEvent(context.Background(), rowsEvent("db1", "user", []interface{}{1, "hiwjd"})))
+	assert.Empty(t, storage.GTIDs)
+	assert.Equal(t, []string{"db1"}, sink.topics())
+	assert.Equal(t, published+1, metricRowsPublished.With("db1", "user", "INSERT").Value())
+
+	assert.Nil(t, r.handleEvent(context.Background(), xidEvent()))
+	assert.Equal(t, []string{"36c0fcec-5447-11ea-8dc1-0242ac110002:7"}, storage.GTIDs)
+}
+
+func TestRunnerSkipCommitWhenPublishFailed(t *testing.T) {
+	storage := &memStorage{}
+	sink := &memSink{err: errors.New("nsqd down")}
+	r := NewRunner(Config{Retry: RetryConfig{MaxAttempts: 1}}, newTestTableMetaManager(), storage, sink)
+
+	// 发布失败时从上次提交的位置重新同步，不继续处理之后的事务
+	assert.Nil(t, r.handleEvent(context.Background(), gtidEvent(8)))
+	err := r.handleEvent(context.Background(), rowsEvent("db1", "user", []interface{}{1, "hiwjd"}))
+	assert.IsType(t, &streamError{}, err)
+	assert.Empty(t, storage.GTIDs)
+
+	// 重新同步时从该事务开始
+	sink.err = nil
+	GTIDSet, err := storage.Read()
+	assert.Nil(t, err)
+	r.reset(GTIDSet)
+	assert.Nil(t, r.handleEvent(context.Background(), gtidEvent(8)))
+	assert.Nil(t, r.handleEvent(context.Background(), rowsEvent("db1", "user", []interface{}{1, "hiwjd"})))
+	assert.Nil(t, r.handleEvent(context.Background(), xidEvent()))
+	assert.Equal(t, []string{"36c0fcec-5447-11ea-8dc1-0242ac110002:8"}, storage.GTIDs)
+
+	// 转换失败时重新同步也会失败，停止同步
+	assert.Nil(t, r.handleEvent(context.Background(), gtidEvent(9)))
+	ev := rowsEvent("db1", "user", []interface{}{2, "wjd"})
+	ev.Header.EventType = replication.QUERY_EVENT
+	err = r.handleEvent(context.Background(), ev)
+	assert.NotNil(t, err)
+	assert.NotEqual(t, reflect.TypeOf(&streamError{}), reflect.TypeOf(err))
+}
+
+// flakySink 前failures次发布失败，onPublish不为nil时在每次发布前调用
+type flakySink struct {
+	memSink
+	failures  int
+	onPublish func()
+}
+
+func (s *flakySink) Publish(msg *Message) error {
+	if s.onPublish != nil {
+		s.onPublish()
+	}
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("nsqd down")
+	}
+	return s.memSink.Publish(msg)
+}
+
+func TestRunnerRetryPublish(t *testing.T) {
+	storage := &memStorage{}
+	sink := &flakySink{failures: 2}
+	r := NewRunner(Config{Retry: RetryConfig{InitialInterval: Duration{time.Millisecond}}}, newTestTableMetaManager(), storage, sink)
+
+	retries := metricPublishRetries.Value()
+	stalls := metricPublishStalls.Value()
+	var firstAttempt time.Time
+	sink.onPublish = func() {
+		if firstAttempt.IsZero() {
+			firstAttempt = time.Now()
+		}
+	}
+
+	assert.Nil(t, r.handleEvent(context.Background(), gtidEvent(20)))
+	assert.Nil(t, r.handleEvent(context.Background(), rowsEvent("db1", "user", []interface{}{1, "hiwjd"})))
+	assert.Nil(t, r.handleEvent(context.Background(), xidEvent()))
+
+	assert.Equal(t, []string{"db1"}, sink.topics())
+	// PublishedAt是成功的那次尝试的时间
+	var dc DataChanged
+	assert.Nil(t, dc.Decode(sink.msgs[0].Body))
+	assert.True(t, dc.PublishedAt.Sub(firstAttempt) >= 3*time.Millisecond)
+	assert.Equal(t, []string{"36c0fcec-5447-11ea-8dc1-0242ac110002:20"}, storage.GTIDs)
+	assert.Equal(t, retries+2, metricPublishRetries.Value())
+	assert.Equal(t, stalls+1, metricPublishStalls.Value())
+	assert.Equal(t, float64(0), metricPublishStalled.Value())
+}
+
+func TestRunnerResyncAfterRetryGiveUp(t *testing.T) {
+	storage := &memStorage{}
+	sink := &flakySink{}
+	config := Config{
+		Retry:     RetryConfig{MaxAttempts: 2, InitialInterval: Duration{time.Millisecond}},
+		Reconnect: ReconnectConfig{InitialInterval: Duration{time.Millisecond}},
+	}
+	r := NewRunner(config, newTestTableMetaManager(), storage, sink)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var sets []string
+	r.connect = func(GTIDSet mysql.GTIDSet) (eventStreamer, error) {
+		sets = append(sets, GTIDSet.String())
+		if len(sets) == 1 {
+			return &scriptStreamer{
+				events: []*replication.BinlogEvent{
+					gtidEvent(7), rowsEvent("db1", "user", []interface{}{1, "a"}), xidEvent(),
+					gtidEvent(8), rowsEvent("db1", "user", []interface{}{2, "b"}), xidEvent(),
+					gtidEvent(9), rowsEvent("db1", "user", []interface{}{3, "c"}), xidEvent(),
+				},
+				err:   errors.New("unexpected event"),
+				onEnd: func() { t.Error("放弃重试后继续读取了之后的事件") },
+			}, nil
+		}
+		return &scriptStreamer{
+			events: []*replication.BinlogEvent{
+				gtidEvent(8), rowsEvent("db1", "user", []interface{}{2, "b"}), xidEvent(),
+				gtidEvent(9), rowsEvent("db1", "user", []interface{}{3, "c"}), xidEvent(),
+			},
+			err:   context.Canceled,
+			onEnd: cancel,
+		}, nil
+	}
+
+	// 第二个事务的发布尝试两次都失败后放弃
+	published := 0
+	sink.onPublish = func() {
+		if published++; published == 2 {
+			sink.failures = 2
+		}
+	}
+
+	assert.Nil(t, r.Run(ctx))
+	assert.Equal(t, []string{"", "36c0fcec-5447-11ea-8dc1-0242ac110002:7"}, sets)
+	// GTIDSet没有越过发布失败的事务，之后按顺序提交
+	assert.Equal(t, []string{
+		"36c0fcec-5447-11ea-8dc1-0242ac110002:7",
+		"36c0fcec-5447-11ea-8dc1-0242ac110002:8",
+		"36c0fcec-5447-11ea-8dc1-0242ac110002:9",
+	}, storage.GTIDs)
+	var ids []interface{}
+	for _, msg := range sink.msgs {
+		ids = append(ids, msg.Data.Changes[0].After["id"])
+	}
+	assert.Equal(t, []interface{}{1, 2, 3}, ids)
+}
+
+func TestRunnerRetryStopsWhenContextDone(t *testing.T) {
+	storage := &memStorage{}
+	sink := &memSink{err: errors.New("nsqd down")}
+	r := NewRunner(Config{Retry: RetryConfig{InitialInterval: Duration{time.Hour}}}, newTestTableMetaManager(), storage, sink)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	assert.Nil(t, r.handleEvent(ctx, gtidEvent(21)))
+	assert.NotNil(t, r.handleEvent(ctx, rowsEvent("db1", "user", []interface{}{1, "hiwjd"})))
+	assert.Empty(t, storage.GTIDs)
+}
+
+func TestRunnerCommitOnQueryEvent(t *testing.T) {
+	storage := &memStorage{}
+	r := NewRunner(Config{}, newTestTableMetaManager(), storage, &memSink{})
+
+	assert.Nil(t, r.handleEvent(context.Background(), gtidEvent(10)))
+	assert.Nil(t, r.handleEvent(context.Background(), &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.QUERY_EVENT},
+		Event:  &replication.QueryEvent{Query: []byte("BEGIN")},
+	}))
+	assert.Empty(t, storage.GTIDs)
+
+	// 不在配置中的表会被忽略，但事务仍然会提交
+	assert.Nil(t, r.handleEvent(context.Background(), rowsEvent("db2", "order", []interface{}{1})))
+	assert.Nil(t, r.handleEvent(context.Background(), &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.QUERY_EVENT},
+		Event:  &replication.QueryEvent{Query: []byte("COMMIT")},
+	}))
+	assert.Equal(t, []string{"36c0fcec-5447-11ea-8dc1-0242ac110002:10"}, storage.GTIDs)
+}
+
+func TestRunnerSourceMetadata(t *testing.T) {
+	sink := &memSink{}
+	r := NewRunner(Config{}, newTestTableMetaManager(), &memStorage{}, sink)
+
+	assert.Nil(t, r.handleEvent(context.Background(), &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.ROTATE_EVENT},
+		Event:  &replication.RotateEvent{Position: 4, NextLogName: []byte("mysql-bin.000003")},
+	}))
+	assert.Nil(t, r.handleEvent(context.Background(), gtidEvent(11)))
+
+	ev := rowsEvent("db1", "user", []interface{}{1, "a"}, []interface{}{2, "b"})
+	ev.Header.ServerID = 1
+	ev.Header.LogPos = 1024
+	ev.Header.Timestamp = 1583823845
+	assert.Nil(t, r.handleEvent(context.Background(), ev))
+	// 不在配置中的表的行也计数
+	assert.Nil(t, r.handleEvent(context.Background(), rowsEvent("db2", "order", []interface{}{1})))
+	assert.Nil(t, r.handleEvent(context.Background(), rowsEvent("db1", "user", []interface{}{3, "c"})))
+
+	assert.Equal(t, 2, len(sink.msgs))
+	assert.Equal(t, Source{
+		ServerID:  1,
+		GTID:      "36c0fcec-5447-11ea-8dc1-0242ac110002:11",
+		File:      "mysql-bin.000003",
+		Pos:       1024,
+		Timestamp: time.Unix(1583823845, 0),
+		RowIndex:  0,
+	}, sink.msgs[0].Data.Source)
+	assert.Equal(t, 3, sink.msgs[1].Data.Source.RowIndex)
+	assert.False(t, sink.msgs[1].Data.PublishedAt.IsZero())
+
+	// 下一个事务重新计数
+	assert.Nil(t, r.handleEvent(context.Background(), xidEvent()))
+	assert.Nil(t, r.handleEvent(context.Background(), gtidEvent(12)))
+	assert.Nil(t, r.handleEvent(context.Background(), rowsEvent("db1", "user", []interface{}{4, "d"})))
+	assert.Equal(t, 0, sink.msgs[2].Data.Source.RowIndex)
+}
+
+// scriptStreamer 依次返回events，之后调用onEnd并返回err
+type scriptStreamer struct {
+	events []*replication.BinlogEvent
+	err    error
+	onEnd  func()
+}
+
+func (s *scriptStreamer) GetEvent(ctx context.Context) (*replication.BinlogEvent, error) {
+	if len(s.events) == 0 {
+		if s.onEnd != nil {
+			s.onEnd()
+		}
+		return nil, s.err
+	}
+	ev := s.events[0]
+	s.events = s.events[1:]
+	return ev, nil
+}
+
+func TestRunnerReconnect(t *testing.T) {
+	storage := &memStorage{}
+	sink := &memSink{}
+	r := NewRunner(Config{Reconnect: ReconnectConfig{InitialInterval: Duration{time.Millisecond}}}, newTestTableMetaManager(), storage, sink)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reconnects := metricBinlogReconnects.Value()
+	var sets []string
+	r.connect = func(GTIDSet mysql.GTIDSet) (eventStreamer, error) {
+		sets = append(sets, GTIDSet.String())
+		switch len(sets) {
+		case 1:
+			// 第二个事务没有提交时断开
+			return &scriptStreamer{
+				events: []*replication.BinlogEvent{
+					gtidEvent(7), rowsEvent("db1", "user", []interface{}{1, "a"}), xidEvent(),
+					gtidEvent(8), rowsEvent("db1", "user", []interface{}{2, "b"}),
+				},
+				err: errors.New("connection reset"),
+			}, nil
+		case 2:
+			return nil, errors.New("connection refused")
+		default:
+			return &scriptStreamer{
+				events: []*replication.BinlogEvent{gtidEvent(8), rowsEvent("db1", "user", []interface{}{2, "b"}), xidEvent()},
+				err:    context.Canceled,
+				onEnd:  cancel,
+			}, nil
+		}
+	}
+
+	assert.Nil(t, r.Run(ctx))
+	assert.Equal(t, []string{
+		"",
+		"36c0fcec-5447-11ea-8dc1-0242ac110002:7",
+		"36c0fcec-5447-11ea-8dc1-0242ac110002:7",
+	}, sets)
+	assert.Equal(t, reconnects+2, metricBinlogReconnects.Value())
+	assert.Equal(t, []string{
+		"36c0fcec-5447-11ea-8dc1-0242ac110002:7",
+		"36c0fcec-5447-11ea-8dc1-0242ac110002:8",
+	}, storage.GTIDs)
+	// 没有提交的事务重连后重新发布
+	assert.Equal(t, 3, len(sink.msgs))
+	assert.Equal(t, sink.msgs[1].Data.Source.GTID, sink.msgs[2].Data.Source.GTID)
+}
+
+func TestRunnerClose(t *testing.T) {
+	r := NewRunner(Config{Reconnect: ReconnectConfig{InitialInterval: Duration{time.Hour}}}, newTestTableMetaManager(), &memStorage{}, &memSink{})
+
+	// 连接断开后等待重连时Close，Run不再重连
+	connected := make(chan struct{}, 10)
+	r.connect = func(GTIDSet mysql.GTIDSet) (eventStreamer, error) {
+		connected <- struct{}{}
+		return nil, errors.New("connection refused")
+	}
+	done := make(chan error)
+	go func() {
+		done <- r.Run(context.Background())
+	}()
+	<-connected
+	assert.Nil(t, r.Close())
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run没有在Close后返回")
+	}
+	assert.Equal(t, 0, len(connected))
+
+	// 同步时Close
+	r = NewRunner(Config{}, newTestTableMetaManager(), &memStorage{}, &memSink{})
+	r.connect = func(GTIDSet mysql.GTIDSet) (eventStreamer, error) {
+		connected <- struct{}{}
+		return silentStreamer{}, nil
+	}
+	go func() {
+		done <- r.Run(context.Background())
+	}()
+	<-connected
+	assert.Nil(t, r.Close())
+	assert.Nil(t, <-done)
+
+	// Close之后Run直接返回
+	assert.Nil(t, r.Run(context.Background()))
+	assert.Equal(t, 0, len(connected))
+}
+
+type memPositionStorage struct {
+	positions []string
+}
+
+func (s *memPositionStorage) Update(pos mysql.Position) error {
+	s.positions = append(s.positions, FormatPosition(pos))
+	return nil
+}
+
+func (s *memPositionStorage) Read() (mysql.Position, error) {
+	if len(s.positions) == 0 {
+		return mysql.Position{Name: "mysql-bin.000001", Pos: 4}, nil
+	}
+	return ParsePosition(s.positions[len(s.positions)-1])
+}
+
+func rotateEvent(logPos uint32, name string, pos uint64) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.ROTATE_EVENT, LogPos: logPos},
+		Event:  &replication.RotateEvent{NextLogName: []byte(name), Position: pos},
+	}
+}
+
+func beginEvent() *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.QUERY_EVENT},
+		Event:  &replication.QueryEvent{Query: []byte("BEGIN")},
+	}
+}
+
+func xidEventAt(logPos uint32) *replication.BinlogEvent {
+	ev := xidEvent()
+	ev.Header.LogPos = logPos
+	return ev
+}
+
+func TestRunnerPositionMode(t *testing.T) {
+	positions := &memPositionStorage{}
+	sink := &memSink{}
+	r := NewRunner(Config{Reconnect: ReconnectConfig{InitialInterval: Duration{time.Millisecond}}}, newTestTableMetaManager(), nil, sink)
+	r.SetPositionStorage(positions)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var starts []string
+	r.connectPosition = func(pos mysql.Position) (eventStreamer, error) {
+		starts = append(starts, FormatPosition(pos))
+		if len(starts) == 1 {
+			// 切换binlog文件后，第三个事务没有提交时断开
+			return &scriptStreamer{
+				events: []*replication.BinlogEvent{
+					rotateEvent(0, "mysql-bin.000001", 4),
+					beginEvent(), rowsEvent("db1", "user", []interface{}{1, "a"}), xidEventAt(300),
+					rotateEvent(400, "mysql-bin.000002", 4),
+					beginEvent(), rowsEvent("db1", "user", []interface{}{2, "b"}), xidEventAt(200),
+					beginEvent(), rowsEvent("db1", "user", []interface{}{3, "c"}),
+				},
+				err: errors.New("connection reset"),
+			}, nil
+		}
+		return &scriptStreamer{
+			events: []*replication.BinlogEvent{
+				rotateEvent(0, "mysql-bin.000002", 200),
+				beginEvent(), rowsEvent("db1", "user", []interface{}{3, "c"}), xidEventAt(350),
+			},
+			err:   context.Canceled,
+			onEnd: cancel,
+		}, nil
+	}
+
+	assert.Nil(t, r.Run(ctx))
+	assert.Equal(t, []string{"mysql-bin.000001:4", "mysql-bin.000002:200"}, starts)
+	assert.Equal(t, []string{
+		"mysql-bin.000001:300",
+		"mysql-bin.000002:4",
+		"mysql-bin.000002:200",
+		"mysql-bin.000002:350",
+	}, positions.positions)
+
+	// 没有提交的事务重连后重新发布
+	assert.Equal(t, 4, len(sink.msgs))
+	assert.Equal(t, "mysql-bin.000001", sink.msgs[0].Data.Source.File)
+	assert.Equal(t, "mysql-bin.000002", sink.msgs[3].Data.Source.File)
+	assert.Equal(t, "", sink.msgs[3].Data.Source.GTID)
+
+	// gtid模式没有binlog位置
+	assert.Equal(t, http.StatusNotFound, adminRequest(NewAdminHandler(NewRunner(Config{}, newTestTableMetaManager(), &memStorage{}, sink)), "GET", "/admin/position").Code)
+	w := adminRequest(NewAdminHandler(r), "GET", "/admin/position")
+	assert.Equal(t, "mysql-bin.000002:350", w.Body.String())
+	assert.Equal(t, http.StatusNotFound, adminRequest(NewAdminHandler(r), "GET", "/admin/gtidset").Code)
+}
+
+func TestRunnerPositionPublishFailed(t *testing.T) {
+	positions := &memPositionStorage{}
+	sink := &memSink{err: errors.New("nsqd down")}
+	r := NewRunner(Config{Retry: RetryConfig{MaxAttempts: 1}}, newTestTableMetaManager(), nil, sink)
+	r.SetPositionStorage(positions)
+	ctx := context.Background()
+
+	// 发布失败时从上次提交的位置重新同步
+	assert.Nil(t, r.handleEvent(ctx, rotateEvent(0, "mysql-bin.000001", 4)))
+	assert.Nil(t, r.handleEvent(ctx, beginEvent()))
+	assert.IsType(t, &streamError{}, r.handleEvent(ctx, rowsEvent("db1", "user", []interface{}{1, "a"})))
+	assert.Empty(t, positions.positions)
+
+	// 重新连接后恢复
+	sink.err = nil
+	r.reset(nil)
+	assert.Nil(t, r.handleEvent(ctx, rotateEvent(0, "mysql-bin.000001", 4)))
+	assert.Nil(t, r.handleEvent(ctx, beginEvent()))
+	assert.Nil(t, r.handleEvent(ctx, rowsEvent("db1", "user", []interface{}{1, "a"})))
+	assert.Nil(t, r.handleEvent(ctx, xidEventAt(300)))
+	assert.Equal(t, []string{"mysql-bin.000001:300"}, positions.positions)
+
+	// Flush失败时也马上重新同步，位置不前进
+	sink.flushErr = errors.New("spool full")
+	assert.Nil(t, r.handleEvent(ctx, beginEvent()))
+	assert.Nil(t, r.handleEvent(ctx, rowsEvent("db1", "user", []interface{}{2, "b"})))
+	assert.IsType(t, &streamError{}, r.handleEvent(ctx, xidEventAt(500)))
+	assert.IsType(t, &streamError{}, r.handleEvent(ctx, rotateEvent(600, "mysql-bin.000002", 4)))
+	assert.Equal(t, []string{"mysql-bin.000001:300"}, positions.positions)
+}
+
+// fakeBinlogServer 是最小的mysql主库，每次binlog dump发送一个RotateEvent后断开连接
+type fakeBinlogServer struct {
+	listener net.Listener
+	conn     *server.Conn
+	dumps    int32
+}
+
+func newFakeBinlogServer(t *testing.T) *fakeBinlogServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &fakeBinlogServer{listener: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeBinlogServer) serve(c net.Conn) {
+	h := &fakeBinlogHandler{server: s, raw: c}
+	conn, err := server.NewConn(c, "root", "", h)
+	if err != nil {
+		return
+	}
+	h.conn = conn
+	for conn.HandleCommand() == nil {
+	}
+}
+
+func (s *fakeBinlogServer) port() uint16 {
+	return uint16(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+type fakeBinlogHandler struct {
+	server.EmptyHandler
+	server *fakeBinlogServer
+	raw    net.Conn
+	conn   *server.Conn
+}
+
+func (h *fakeBinlogHandler) HandleQuery(query string) (*mysql.Result, error) {
+	rs, err := mysql.BuildSimpleTextResultset([]string{"Variable_name", "Value"}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &mysql.Result{Resultset: rs}, nil
+}
+
+func (h *fakeBinlogHandler) HandleOtherCommand(cmd byte, data []byte) error {
+	if cmd != mysql.COM_BINLOG_DUMP_GTID {
+		return nil
+	}
+	atomic.AddInt32(&h.server.dumps, 1)
+
+	// 连接时的RotateEvent
+	name := []byte("mysql-bin.000001")
+	event := make([]byte, 19+8+len(name))
+	event[4] = byte(replication.ROTATE_EVENT)
+	binary.LittleEndian.PutUint32(event[9:], uint32(len(event)))
+	binary.LittleEndian.PutUint64(event[19:], 4)
+	copy(event[27:], name)
+	h.conn.WritePacket(append([]byte{0, 0, 0, 0, mysql.OK_HEADER}, event...))
+
+	// 同步中途断开
+	h.raw.Close()
+	return nil
+}
+
+func TestRunnerReconnectAfterDisconnect(t *testing.T) {
+	s := newFakeBinlogServer(t)
+	defer s.listener.Close()
+
+	config := Config{
+		Mysql:     MysqlConfig{ServerID: 100, Host: "127.0.0.1", Port: s.port(), User: "root"},
+		Reconnect: ReconnectConfig{InitialInterval: Duration{time.Millisecond}},
+	}
+	r := NewRunner(config, newTestTableMetaManager(), &memStorage{}, &memSink{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 断开的错误要交给Run重连，而不是在go-mysql里面重连
+	var connects int32
+	r.connect = func(GTIDSet mysql.GTIDSet) (eventStreamer, error) {
+		if atomic.AddInt32(&connects, 1) == 3 {
+			cancel()
+		}
+		return r.connectMySQL(GTIDSet)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("binlog连接断开后没有重连")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&connects))
+	assert.True(t, atomic.LoadInt32(&s.dumps) >= 2)
+}
+
+func TestRunnerGiveUpReconnect(t *testing.T) {
+	r := NewRunner(Config{Reconnect: ReconnectConfig{MaxAttempts: 2, InitialInterval: Duration{time.Millisecond}}}, newTestTableMetaManager(), &memStorage{}, &memSink{})
+
+	var connects int
+	r.connect = func(GTIDSet mysql.GTIDSet) (eventStreamer, error) {
+		connects++
+		return nil, errors.New("connection refused")
+	}
+
+	assert.NotNil(t, r.Run(context.Background()))
+	assert.Equal(t, 3, connects)
+}
+
+func TestRunnerReload(t *testing.T) {
+	storage := &memStorage{}
+	sink := &memSink{}
+	tmm := newTestTableMetaManager()
+	r := NewRunner(Config{Mysql: MysqlConfig{ServerID: 102}}, tmm, storage, sink)
+
+	assert.Nil(t, r.Reload(Config{
+		Mysql:         MysqlConfig{ServerID: 103},
+		Schemas:       []SchemaConfig{{Name: "db2"}},
+		MessageFormat: FormatChanges,
+	}))
+	// 同步的库和表立即生效
+	assert.False(t, tmm.Includes("db1", "user"))
+	assert.True(t, tmm.Includes("db2", "order"))
+
+	// 其他配置在处理下一个事件前生效
+	assert.Equal(t, MessageFormat(""), r.config.MessageFormat)
+	assert.Nil(t, r.applyReloaded())
+	assert.Equal(t, FormatChanges, r.config.MessageFormat)
+	assert.Equal(t, uint32(102), r.config.Mysql.ServerID)
+
+	// topic配置错误时不生效
+	assert.NotNil(t, r.Reload(Config{Topic: "{unknown}"}))
+}
+
+func TestRunnerTopic(t *testing.T) {
+	sink := &memSink{}
+	config := Config{Topic: "cdc.{schema}.{table}"}
+	r := NewRunner(config, newTestTableMetaManager(), &memStorage{}, sink)
+	router, err := NewRouter(config, nil)
+	assert.Nil(t, err)
+	r.router = router
+
+	assert.Nil(t, r.handleEvent(context.Background(), gtidEvent(7)))
+	assert.Nil(t, r.handleEvent(context.Background(), rowsEvent("db1", "user", []interface{}{1, "a"})))
+	assert.Nil(t, r.handleEvent(context.Background(), xidEvent()))
+	assert.Equal(t, []string{"cdc.db1.user"}, sink.topics())
+}
+
+func TestRunnerShards(t *testing.T) {
+	sink := &memSink{}
+	config := Config{
+		Schemas:       []SchemaConfig{{Name: "db1", Tables: []string{"user"}, TableConfigs: map[string]TableConfig{"user": {Shards: 8, ShardKey: "id"}}}},
+		MessageFormat: FormatChanges,
+	}
+	r := NewRunner(config, newTestTableMetaManager(), &memStorage{}, sink)
+	router, err := NewRouter(config, nil)
+	assert.Nil(t, err)
+	r.router = router
+
+	rows := [][]interface{}{{1, "a"}, {2, "b"}, {3, "c"}, {4, "d"}}
+	assert.Nil(t, r.handleEvent(context.Background(), gtidEvent(7)))
+	assert.Nil(t, r.handleEvent(context.Background(), rowsEvent("db1", "user", rows...)))
+	assert.Nil(t, r.handleEvent(context.Background(), xidEvent()))
+
+	// 每个分片一条消息，合起来是所有的行
+	assert.True(t, len(sink.msgs) > 1)
+	var n int
+	for _, msg := range sink.msgs {
+		var dc DataChanged
+		assert.Nil(t, dc.Decode(msg.Body))
+		assert.Regexp(t, `^db1\.[0-7]$`, msg.Topic)
+		assert.Equal(t, len(dc.Changes), len(dc.Source.RowIndexes))
+		n += len(dc.Changes)
+	}
+	assert.Equal(t, 4, n)
+
+	// 换了分片的UPDATE发往两个分片，发布的行数只算一次
+	update := func(id int) *DataChanged {
+		return &DataChanged{Schema: "db1", Table: "user", Action: UPDATE, Changes: []RowChange{{
+			Before: map[string]interface{}{"id": 1, "name": "a"},
+			After:  map[string]interface{}{"id": id, "name": "a"},
+		}}}
+	}
+	id := 2
+	for len(r.router.Route(update(id))) != 2 {
+		id++
+	}
+	published := metricRowsPublished.With("db1", "user", "UPDATE").Value()
+	sink.msgs = nil
+	assert.Nil(t, r.publishData(context.Background(), update(id)))
+	assert.Equal(t, 2, len(sink.msgs))
+	assert.Equal(t, published+1, metricRowsPublished.With("db1", "user", "UPDATE").Value())
+}
@@ -0,0 +1,217 @@
+package mysql2nsq
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// SchemaVersion 是某张表的一个表结构版本
+type SchemaVersion struct {
+	Schema string
+	Table  string
+	// GTIDSet 是该版本生效时已经执行的GTIDSet，包含引起变化的DDL
+	GTIDSet string
+	// Columns 为空表示表被删除了
+	Columns    []Column
+	PrimaryKey []string `json:",omitempty"`
+}
+
+type schemaVersion struct {
+	SchemaVersion
+	set mysql.GTIDSet
+}
+
+// SchemaHistory 记录表结构的历史版本
+//
+// 从较早的GTIDSet重新同步时，用事件发生时的表结构解析数据，而不是information_schema里当前的表结构
+// 历史版本按binlog中的顺序追加到文件中，每行一个json编码的SchemaVersion
+type SchemaHistory struct {
+	lock     sync.RWMutex
+	file     *os.File
+	versions []schemaVersion
+	// tables 是每张表的版本在versions中的下标，按追加的顺序排列，Lookup只需要查找这张表的版本
+	tables map[TableRef][]int
+}
+
+// NewSchemaHistory 打开filePath指定的表结构历史文件，文件不存在时创建
+func NewSchemaHistory(filePath string) (*SchemaHistory, error) {
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := readSchemaVersions(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read schema history %s failed: %s", filePath, err)
+	}
+
+	return &SchemaHistory{file: file, versions: versions, tables: indexSchemaVersions(versions)}, nil
+}
+
+// indexSchemaVersions 返回每张表的版本在versions中的下标
+func indexSchemaVersions(versions []schemaVersion) map[TableRef][]int {
+	tables := make(map[TableRef][]int)
+	for i, v := range versions {
+		ref := TableRef{Schema: v.Schema, Table: v.Table}
+		tables[ref] = append(tables[ref], i)
+	}
+	return tables
+}
+
+func readSchemaVersions(r io.Reader) ([]schemaVersion, error) {
+	var versions []schemaVersion
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var v schemaVersion
+		if err := json.Unmarshal(scanner.Bytes(), &v.SchemaVersion); err != nil {
+			return nil, err
+		}
+
+		var err error
+		if v.set, err = mysql.ParseMysqlGTIDSet(v.GTIDSet); err != nil {
+			return nil, err
+		}
+
+		versions = append(versions, v)
+	}
+
+	return versions, scanner.Err()
+}
+
+// Empty 返回是否还没有记录任何版本
+func (h *SchemaHistory) Empty() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return len(h.versions) == 0
+}
+
+// Append 追加版本，写入文件后才返回
+func (h *SchemaHistory) Append(versions ...SchemaVersion) error {
+	parsed := make([]schemaVersion, 0, len(versions))
+	var buf []byte
+	for _, v := range versions {
+		set, err := mysql.ParseMysqlGTIDSet(v.GTIDSet)
+		if err != nil {
+			return err
+		}
+
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, bs...), '\n')
+		parsed = append(parsed, schemaVersion{SchemaVersion: v, set: set})
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, err := h.file.Write(buf); err != nil {
+		return err
+	}
+	if err := h.file.Sync(); err != nil {
+		return err
+	}
+
+	for _, v := range parsed {
+		ref := TableRef{Schema: v.Schema, Table: v.Table}
+		h.tables[ref] = append(h.tables[ref], len(h.versions))
+		h.versions = append(h.versions, v)
+	}
+	return nil
+}
+
+// Lookup 返回executed位置时表的结构版本，也就是GTIDSet被executed包含的最后一个版本
+func (h *SchemaHistory) Lookup(schemaName, tableName string, executed mysql.GTIDSet) (*SchemaVersion, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	// 通常最后一个版本就满足条件，只在从较早的位置重新同步时才需要往前找
+	indexes := h.tables[TableRef{Schema: schemaName, Table: tableName}]
+	for i := len(indexes) - 1; i >= 0; i-- {
+		v := h.versions[indexes[i]]
+		if executed.Contain(v.set) {
+			return &v.SchemaVersion, true
+		}
+	}
+
+	return nil, false
+}
+
+// Recorded 返回executed位置是否已经被记录过，也就是某个版本的GTIDSet包含了executed
+// 重新同步已经记录过的DDL时，不需要再读取表结构
+func (h *SchemaHistory) Recorded(executed mysql.GTIDSet) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	for _, v := range h.versions {
+		if v.set.Contain(executed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Export 把所有版本写到w
+func (h *SchemaHistory) Export(w io.Writer) error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	enc := json.NewEncoder(w)
+	for _, v := range h.versions {
+		if err := enc.Encode(v.SchemaVersion); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Import 用r中的版本替换当前所有版本
+func (h *SchemaHistory) Import(r io.Reader) error {
+	versions, err := readSchemaVersions(r)
+	if err != nil {
+		return err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err = h.file.Truncate(0); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(h.file)
+	for _, v := range versions {
+		if err = enc.Encode(v.SchemaVersion); err != nil {
+			return err
+		}
+	}
+	if err = h.file.Sync(); err != nil {
+		return err
+	}
+
+	h.versions = versions
+	h.tables = indexSchemaVersions(versions)
+	return nil
+}
+
+// Close 关闭文件
+func (h *SchemaHistory) Close() error {
+	return h.file.Close()
+}
@@ -0,0 +1,194 @@
+package mysql2nsq
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseGTIDSet(t *testing.T, s string) mysql.GTIDSet {
+	set, err := mysql.ParseMysqlGTIDSet(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestSchemaHistoryLookup(t *testing.T) {
+	fn := "schema-history-lookup"
+	defer os.Remove(fn)
+
+	h, err := NewSchemaHistory(fn)
+	assert.Nil(t, err)
+	assert.True(t, h.Empty())
+
+	v1 := SchemaVersion{Schema: "db1", Table: "user", GTIDSet: "36c0fcec-5447-11ea-8dc1-0242ac110002:1-10", Columns: []Column{{ColumnName: "id"}}}
+	v2 := SchemaVersion{Schema: "db1", Table: "user", GTIDSet: "36c0fcec-5447-11ea-8dc1-0242ac110002:1-20", Columns: []Column{{ColumnName: "id"}, {ColumnName: "age"}}}
+	assert.Nil(t, h.Append(v1))
+	assert.Nil(t, h.Append(v2))
+	h.Close()
+
+	// 重新打开后仍然存在
+	h, err = NewSchemaHistory(fn)
+	assert.Nil(t, err)
+	defer h.Close()
+	assert.False(t, h.Empty())
+
+	_, ok := h.Lookup("db1", "user", mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-5"))
+	assert.False(t, ok)
+
+	v, ok := h.Lookup("db1", "user", mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-15"))
+	assert.True(t, ok)
+	assert.Equal(t, v1, *v)
+
+	v, ok = h.Lookup("db1", "user", mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-21"))
+	assert.True(t, ok)
+	assert.Equal(t, v2, *v)
+
+	_, ok = h.Lookup("db1", "order", mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-21"))
+	assert.False(t, ok)
+
+	assert.True(t, h.Recorded(mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-20")))
+	assert.False(t, h.Recorded(mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-21")))
+}
+
+func TestSchemaHistoryIndex(t *testing.T) {
+	fn := "schema-history-index"
+	defer os.Remove(fn)
+
+	h, err := NewSchemaHistory(fn)
+	assert.Nil(t, err)
+	defer h.Close()
+
+	// 多张表的版本交错追加，查找时只看这张表的版本
+	for i := 1; i <= 3; i++ {
+		set := fmt.Sprintf("36c0fcec-5447-11ea-8dc1-0242ac110002:1-%d", i*10)
+		assert.Nil(t, h.Append(
+			SchemaVersion{Schema: "db1", Table: "user", GTIDSet: set, Columns: make([]Column, i)},
+			SchemaVersion{Schema: "db1", Table: "order", GTIDSet: set, Columns: make([]Column, i+10)},
+		))
+	}
+	assert.Equal(t, []int{0, 2, 4}, h.tables[TableRef{Schema: "db1", Table: "user"}])
+	assert.Equal(t, []int{1, 3, 5}, h.tables[TableRef{Schema: "db1", Table: "order"}])
+
+	v, ok := h.Lookup("db1", "order", mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-25"))
+	assert.True(t, ok)
+	assert.Equal(t, 12, len(v.Columns))
+	v, ok = h.Lookup("db1", "user", mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-30"))
+	assert.True(t, ok)
+	assert.Equal(t, 3, len(v.Columns))
+
+	// 导入后重新建立索引
+	var buf bytes.Buffer
+	assert.Nil(t, h.Export(&buf))
+	lines := strings.SplitAfter(buf.String(), "\n")
+	assert.Nil(t, h.Import(strings.NewReader(lines[1]+lines[2])))
+	assert.Equal(t, []int{1}, h.tables[TableRef{Schema: "db1", Table: "user"}])
+	assert.Equal(t, []int{0}, h.tables[TableRef{Schema: "db1", Table: "order"}])
+	v, ok = h.Lookup("db1", "user", mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-30"))
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(v.Columns))
+}
+
+func TestSchemaHistoryExportImport(t *testing.T) {
+	fn1, fn2 := "schema-history-export", "schema-history-import"
+	defer os.Remove(fn1)
+	defer os.Remove(fn2)
+
+	h1, err := NewSchemaHistory(fn1)
+	assert.Nil(t, err)
+	defer h1.Close()
+	v := SchemaVersion{Schema: "db1", Table: "user", GTIDSet: "36c0fcec-5447-11ea-8dc1-0242ac110002:1-10", Columns: []Column{{ColumnName: "id"}}}
+	assert.Nil(t, h1.Append(v))
+
+	var buf bytes.Buffer
+	assert.Nil(t, h1.Export(&buf))
+
+	h2, err := NewSchemaHistory(fn2)
+	assert.Nil(t, err)
+	defer h2.Close()
+	assert.Nil(t, h2.Append(SchemaVersion{Schema: "db2", Table: "order", GTIDSet: ""}))
+	assert.Nil(t, h2.Import(&buf))
+
+	var buf2 bytes.Buffer
+	assert.Nil(t, h2.Export(&buf2))
+	var buf1 bytes.Buffer
+	assert.Nil(t, h1.Export(&buf1))
+	assert.Equal(t, buf1.String(), buf2.String())
+
+	// 导入的内容写入了文件
+	h3, err := NewSchemaHistory(fn2)
+	assert.Nil(t, err)
+	defer h3.Close()
+	got, ok := h3.Lookup("db1", "user", mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-10"))
+	assert.True(t, ok)
+	assert.Equal(t, v, *got)
+}
+
+func TestQueryAtSchemaVersion(t *testing.T) {
+	fn := "schema-history-query-at"
+	defer os.Remove(fn)
+
+	h, err := NewSchemaHistory(fn)
+	assert.Nil(t, err)
+	defer h.Close()
+
+	tmm := newTestTableMetaManager()
+	tmm.SetSchemaHistory(h)
+	assert.Nil(t, tmm.BootstrapSchemaHistory(mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-10")))
+	assert.Nil(t, h.Append(SchemaVersion{Schema: "db1", Table: "user", GTIDSet: "36c0fcec-5447-11ea-8dc1-0242ac110002:1-20"}))
+
+	tbl, err := tmm.At(mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-11")).Query("db1", "user")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(tbl.Columns))
+
+	// 表在GTID 20被删除
+	_, err = tmm.At(mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-20")).Query("db1", "user")
+	assert.Equal(t, ErrNotFound, err)
+
+	// 已经记录过的DDL不会重新读取表结构
+	assert.Nil(t, tmm.HandleDDL("db1", "DROP TABLE user", mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-20")))
+}
+
+func TestRunnerRecordReloadedSchema(t *testing.T) {
+	fn := "schema-history-reload"
+	defer os.Remove(fn)
+
+	h, err := NewSchemaHistory(fn)
+	assert.Nil(t, err)
+	defer h.Close()
+
+	tmm := newTestTableMetaManager()
+	tmm.SetSchemaHistory(h)
+	r := NewRunner(Config{}, tmm, &memStorage{}, &memSink{})
+	r.reset(mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-10"))
+	assert.Nil(t, tmm.BootstrapSchemaHistory(r.position))
+	assert.Nil(t, r.handleEvent(context.Background(), gtidEvent(11)))
+
+	// 重新读取到新的列，在处理下一个事件前作为当前位置的版本记录下来
+	table, _ := tmm.Query("db1", "user")
+	reloaded := *table
+	reloaded.Columns = append(append([]Column(nil), table.Columns...), Column{ColumnName: "score", OrdinalPosition: 3, DataType: "int"})
+	tmm.schemas = withTable(tmm.schemas, "db1", reloaded)
+	r.setSchemaReloaded()
+	assert.Nil(t, r.applyReloaded())
+
+	tbl, err := tmm.At(mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-10")).Query("db1", "user")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(tbl.Columns))
+	tbl, err = tmm.At(mustParseGTIDSet(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-11")).Query("db1", "user")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(tbl.Columns))
+
+	// 只记录一次
+	assert.Nil(t, r.applyReloaded())
+	var buf bytes.Buffer
+	assert.Nil(t, h.Export(&buf))
+	assert.Equal(t, 2, strings.Count(buf.String(), "\n"))
+}
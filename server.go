@@ -0,0 +1,73 @@
+package mysql2nsq
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/siddontang/go-log/log"
+)
+
+// Server 是可选的HTTP服务，/metrics 以Prometheus的文本格式输出指标
+type Server struct {
+	mux    *http.ServeMux
+	server *http.Server
+}
+
+// NewServer 返回监听 HTTPConfig.Addr 的Server实例，调用 Start 后才开始监听
+func NewServer(config HTTPConfig) *Server {
+	s := newServer(config.Addr)
+	s.mux.Handle("/metrics", MetricsHandler())
+	return s
+}
+
+// NewAdminServer 返回只提供管理接口的Server，监听 HTTPConfig.AdminAddr，没有配置时返回nil
+// 管理接口可以暂停发布、重新读取表结构，不和/metrics共用监听地址
+func NewAdminServer(config HTTPConfig, runner *Runner) *Server {
+	if config.AdminAddr == "" {
+		return nil
+	}
+
+	s := newServer(config.AdminAddr)
+	s.mux.Handle("/admin/", NewAdminHandler(runner))
+	return s
+}
+
+func newServer(addr string) *Server {
+	mux := http.NewServeMux()
+	return &Server{
+		mux:    mux,
+		server: &http.Server{Addr: addr, Handler: mux},
+	}
+}
+
+// Handle 注册pattern的处理函数
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start 开始监听，在另一个goroutine中处理请求
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("HTTP server listening on %s\n", ln.Addr())
+	go func() {
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("HTTP server stopped: %s\n", err)
+		}
+	}()
+
+	return nil
+}
+
+// Close 停止监听，等待正在处理的请求结束
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return s.server.Shutdown(ctx)
+}
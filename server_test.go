@@ -0,0 +1,44 @@
+package mysql2nsq
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerMetrics(t *testing.T) {
+	s := NewServer(HTTPConfig{})
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain"))
+	body, _ := ioutil.ReadAll(w.Body)
+	assert.True(t, strings.Contains(string(body), "mysql2nsq_binlog_events_total"))
+}
+
+func TestAdminServer(t *testing.T) {
+	r := NewRunner(Config{}, newTestTableMetaManager(), &memStorage{}, &memSink{})
+
+	// 只开启/metrics时不启动管理接口
+	assert.Nil(t, NewAdminServer(HTTPConfig{}, r))
+	assert.Nil(t, NewAdminServer(HTTPConfig{Addr: "0.0.0.0:9200"}, r))
+	s := NewAdminServer(HTTPConfig{Addr: "0.0.0.0:9200", AdminAddr: "127.0.0.1:9201"}, r)
+	assert.Equal(t, "127.0.0.1:9201", s.server.Addr)
+
+	w := httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest("GET", "/admin/status", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	s.mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	NewServer(HTTPConfig{}).mux.ServeHTTP(w, httptest.NewRequest("POST", "/admin/pause", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.False(t, r.Status().Paused)
+}
@@ -0,0 +1,73 @@
+package mysql2nsq
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Message 是投递给Sink的消息
+type Message struct {
+	Topic string
+	// Body 是编码后的DataChanged
+	Body []byte
+	// Data 是Body编码前的DataChanged，Sink可以用它做更细的路由，可能为nil
+	// spool只保存Topic和Body，从spool中投递的消息Data总是nil，按Data路由的Sink需要自己解码Body
+	Data *DataChanged
+}
+
+// Sink 是数据变化的投递目标
+//
+// Publish 和 PublishBatch 返回nil不代表消息已经可靠送达，
+// 调用方在更新GTIDSet前会调用 Flush，Flush 返回nil后之前投递的消息必须已经送达
+type Sink interface {
+	Publish(msg *Message) error
+	PublishBatch(msgs []*Message) error
+	Flush() error
+	Close() error
+}
+
+// Pinger 是可以检查是否可用的Sink
+type Pinger interface {
+	Ping() error
+}
+
+// Reloader 是可以在运行时应用新配置的Sink
+type Reloader interface {
+	Reload(config Config) error
+}
+
+// SinkFactory 根据配置构造Sink
+type SinkFactory func(config Config) (Sink, error)
+
+var (
+	sinkFactoriesLock sync.RWMutex
+	sinkFactories     = map[string]SinkFactory{
+		"nsq": newNsqSink,
+	}
+)
+
+// RegisterSink 注册一种Sink，之后可以在配置中通过`[sink] type = name`选用
+func RegisterSink(name string, factory SinkFactory) {
+	sinkFactoriesLock.Lock()
+	defer sinkFactoriesLock.Unlock()
+
+	sinkFactories[name] = factory
+}
+
+// NewSink 根据配置构造Sink，没有配置类型时使用nsq
+func NewSink(config Config) (Sink, error) {
+	typ := config.Sink.Type
+	if typ == "" {
+		typ = "nsq"
+	}
+
+	sinkFactoriesLock.RLock()
+	factory, ok := sinkFactories[typ]
+	sinkFactoriesLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown sink type: %s", typ)
+	}
+
+	return factory(config)
+}
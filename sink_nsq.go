@@ -0,0 +1,441 @@
+package mysql2nsq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/siddontang/go-log/log"
+)
+
+const (
+	// NsqStrategySticky 一直使用同一个nsqd，失败时才切换到下一个，尽量保证每个topic中消息的顺序
+	NsqStrategySticky = "sticky"
+	// NsqStrategyRoundRobin 轮流使用所有可用的nsqd，不保证消息的顺序
+	NsqStrategyRoundRobin = "round_robin"
+)
+
+var metricNsqdFailovers = newCounter("mysql2nsq_nsqd_failovers_total", "发布失败后切换nsqd的次数")
+
+// nsqProducer 是nsq.Producer中用到的方法
+type nsqProducer interface {
+	Publish(topic string, body []byte) error
+	MultiPublish(topic string, body [][]byte) error
+	Ping() error
+	Stop()
+}
+
+// nsqSink 把消息发布到nsqd
+//
+// nsqd来自配置的地址和nsqlookupd，定期重新查询nsqlookupd并检查失败的nsqd是否恢复
+// 发布失败时把该nsqd标记为不可用，切换到下一个可用的nsqd重试
+type nsqSink struct {
+	config NsqConfig
+	// newProducer 创建nsqd的producer，测试时替换
+	newProducer func(addr string) (nsqProducer, error)
+
+	lock      sync.Mutex
+	addrs     []string
+	producers map[string]nsqProducer
+	unhealthy map[string]bool
+	// current 是当前使用的nsqd
+	current string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newNsqSink(config Config) (Sink, error) {
+	return newNsqSinkWithProducer(nsqConfigOf(config), func(addr string) (nsqProducer, error) {
+		return nsq.NewProducer(addr, nsq.NewConfig())
+	})
+}
+
+// nsqConfigOf 返回合并了NsqdAddr的NsqConfig
+func nsqConfigOf(config Config) NsqConfig {
+	nsqConfig := config.Nsq
+	if config.NsqdAddr != "" {
+		nsqConfig.NsqdAddrs = append([]string{config.NsqdAddr}, nsqConfig.NsqdAddrs...)
+	}
+	return nsqConfig
+}
+
+func checkNsqStrategy(config *NsqConfig) error {
+	switch config.Strategy {
+	case "":
+		config.Strategy = NsqStrategySticky
+	case NsqStrategySticky, NsqStrategyRoundRobin:
+	default:
+		return fmt.Errorf("unknown nsq strategy: %s", config.Strategy)
+	}
+	return nil
+}
+
+func newNsqSinkWithProducer(config NsqConfig, newProducer func(addr string) (nsqProducer, error)) (*nsqSink, error) {
+	if err := checkNsqStrategy(&config); err != nil {
+		return nil, err
+	}
+
+	s := &nsqSink{
+		config:      config,
+		newProducer: newProducer,
+		producers:   make(map[string]nsqProducer),
+		unhealthy:   make(map[string]bool),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	s.discover()
+	if len(s.addrs) == 0 {
+		return nil, errors.New("no nsqd address")
+	}
+
+	interval := config.DiscoveryInterval.Duration
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	go s.loop(interval)
+
+	return s, nil
+}
+
+// Publish implement Sink
+func (s *nsqSink) Publish(msg *Message) error {
+	return s.do(func(p nsqProducer) error {
+		return p.Publish(msg.Topic, msg.Body)
+	})
+}
+
+// PublishBatch implement Sink
+// 相同topic的连续消息使用一次MPUB发布
+func (s *nsqSink) PublishBatch(msgs []*Message) error {
+	for i := 0; i < len(msgs); {
+		j := i + 1
+		for j < len(msgs) && msgs[j].Topic == msgs[i].Topic {
+			j++
+		}
+
+		bodies := make([][]byte, 0, j-i)
+		for _, msg := range msgs[i:j] {
+			bodies = append(bodies, msg.Body)
+		}
+
+		topic := msgs[i].Topic
+		if err := s.do(func(p nsqProducer) error {
+			return p.MultiPublish(topic, bodies)
+		}); err != nil {
+			return err
+		}
+		i = j
+	}
+
+	return nil
+}
+
+// Ping implement Pinger
+// 只检查当前会使用的nsqd，不切换nsqd，也不标记不可用，不加锁等待网络
+func (s *nsqSink) Ping() error {
+	s.lock.Lock()
+	addr := s.current
+	if addr == "" || s.unhealthy[addr] {
+		addr = s.nextAddr(addr)
+	}
+	if addr == "" {
+		s.lock.Unlock()
+		return errors.New("no healthy nsqd")
+	}
+	p, err := s.producer(addr)
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err = p.Ping(); err != nil {
+		return fmt.Errorf("nsqd %s: %s", addr, err)
+	}
+	return nil
+}
+
+// Reload implement Reloader
+// 使用新的nsqd、nsqlookupd和策略，DiscoveryInterval不会改变
+func (s *nsqSink) Reload(config Config) error {
+	nsqConfig := nsqConfigOf(config)
+	if err := checkNsqStrategy(&nsqConfig); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	nsqConfig.DiscoveryInterval = s.config.DiscoveryInterval
+	s.config = nsqConfig
+	s.lock.Unlock()
+
+	s.discover()
+	return nil
+}
+
+// Flush implement Sink
+// nsq的发布是同步的，Publish返回时nsqd已经确认
+func (s *nsqSink) Flush() error {
+	return nil
+}
+
+// Close implement Sink
+func (s *nsqSink) Close() error {
+	s.lock.Lock()
+	select {
+	case <-s.stop:
+		s.lock.Unlock()
+		return nil
+	default:
+	}
+	close(s.stop)
+	s.lock.Unlock()
+
+	<-s.done
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, p := range s.producers {
+		p.Stop()
+	}
+	s.producers = make(map[string]nsqProducer)
+	return nil
+}
+
+// do 在选中的nsqd上执行fn，失败时依次换下一个可用的nsqd，都失败时返回最后一个错误
+func (s *nsqSink) do(fn func(p nsqProducer) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.nextAddr("") == "" {
+		// 都不可用时全部再试一次
+		s.unhealthy = make(map[string]bool)
+	}
+	if s.config.Strategy == NsqStrategyRoundRobin && s.current != "" {
+		s.current = s.nextAddr(s.current)
+	}
+
+	var lastErr error
+	for tried := 0; tried < len(s.addrs); tried++ {
+		addr := s.current
+		if addr == "" || s.unhealthy[addr] {
+			if addr = s.nextAddr(addr); addr == "" {
+				break
+			}
+			if s.current != "" {
+				log.Warnf("切换nsqd %s -> %s\n", s.current, addr)
+				metricNsqdFailovers.Inc()
+			}
+			s.current = addr
+		}
+
+		p, err := s.producer(addr)
+		if err == nil {
+			if err = fn(p); err == nil {
+				return nil
+			}
+		}
+
+		log.Warnf("nsqd %s 发布失败: %s\n", addr, err)
+		s.unhealthy[addr] = true
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no healthy nsqd")
+	}
+	return lastErr
+}
+
+// nextAddr 返回addr之后第一个可用的nsqd，没有时返回空字符串，调用时需持有锁
+func (s *nsqSink) nextAddr(addr string) string {
+	start := sort.SearchStrings(s.addrs, addr)
+	if start < len(s.addrs) && s.addrs[start] == addr {
+		start++
+	}
+	for i := 0; i < len(s.addrs); i++ {
+		next := s.addrs[(start+i)%len(s.addrs)]
+		if !s.unhealthy[next] {
+			return next
+		}
+	}
+	return ""
+}
+
+// producer 返回addr的producer，没有时创建，调用时需持有锁
+func (s *nsqSink) producer(addr string) (nsqProducer, error) {
+	if p, ok := s.producers[addr]; ok {
+		return p, nil
+	}
+
+	p, err := s.newProducer(addr)
+	if err != nil {
+		return nil, err
+	}
+	s.producers[addr] = p
+	return p, nil
+}
+
+func (s *nsqSink) loop(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.discover()
+			s.checkUnhealthy()
+		}
+	}
+}
+
+// discover 合并配置的nsqd和从nsqlookupd查询到的nsqd
+// nsqlookupd都查询失败时保留原来的nsqd
+func (s *nsqSink) discover() {
+	s.lock.Lock()
+	config := s.config
+	s.lock.Unlock()
+
+	addrs := make(map[string]bool)
+	for _, addr := range config.NsqdAddrs {
+		addrs[addr] = true
+	}
+
+	var lookupFailed bool
+	for _, lookupd := range config.LookupdHTTPAddrs {
+		nodes, err := lookupNsqdNodes(lookupd)
+		if err != nil {
+			log.Warnf("查询nsqlookupd %s 失败: %s\n", lookupd, err)
+			lookupFailed = true
+			continue
+		}
+		for _, addr := range nodes {
+			addrs[addr] = true
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if lookupFailed {
+		for _, addr := range s.addrs {
+			addrs[addr] = true
+		}
+	}
+
+	list := make([]string, 0, len(addrs))
+	for addr := range addrs {
+		list = append(list, addr)
+	}
+	sort.Strings(list)
+
+	if strings.Join(list, ",") != strings.Join(s.addrs, ",") {
+		log.Infof("nsqd: %s\n", strings.Join(list, ", "))
+	}
+
+	// 停掉已经不存在的nsqd
+	for addr, p := range s.producers {
+		if !addrs[addr] {
+			p.Stop()
+			delete(s.producers, addr)
+			delete(s.unhealthy, addr)
+		}
+	}
+	if !addrs[s.current] {
+		s.current = ""
+	}
+	s.addrs = list
+}
+
+// checkUnhealthy 检查不可用的nsqd是否恢复了
+// sticky策略下恢复的nsqd不会马上被使用，直到当前的nsqd失败
+func (s *nsqSink) checkUnhealthy() {
+	s.lock.Lock()
+	var addrs []string
+	for addr := range s.unhealthy {
+		addrs = append(addrs, addr)
+	}
+	s.lock.Unlock()
+
+	for _, addr := range addrs {
+		s.lock.Lock()
+		p, err := s.producer(addr)
+		s.lock.Unlock()
+		if err == nil {
+			err = p.Ping()
+		}
+		if err != nil {
+			log.Debugf("nsqd %s 仍然不可用: %s\n", addr, err)
+			continue
+		}
+
+		log.Infof("nsqd %s 恢复了\n", addr)
+		s.lock.Lock()
+		delete(s.unhealthy, addr)
+		s.lock.Unlock()
+	}
+}
+
+type lookupdNode struct {
+	BroadcastAddress string `json:"broadcast_address"`
+	TCPPort          int    `json:"tcp_port"`
+}
+
+type lookupdNodes struct {
+	Producers []lookupdNode `json:"producers"`
+	// nsqlookupd 1.0之前的版本外面包了一层data
+	Data struct {
+		Producers []lookupdNode `json:"producers"`
+	} `json:"data"`
+}
+
+var lookupdClient = &http.Client{Timeout: 5 * time.Second}
+
+// lookupNsqdNodes 查询nsqlookupd的/nodes接口，返回所有nsqd的TCP地址
+func lookupNsqdNodes(lookupd string) ([]string, error) {
+	endpoint := lookupd
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		endpoint = "http://" + endpoint
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/") + "/nodes"
+
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.nsq; version=1.0")
+
+	resp, err := lookupdClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var nodes lookupdNodes
+	if err = json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		return nil, err
+	}
+
+	producers := append(nodes.Producers, nodes.Data.Producers...)
+	addrs := make([]string, 0, len(producers))
+	for _, p := range producers {
+		addrs = append(addrs, net.JoinHostPort(p.BroadcastAddress, strconv.Itoa(p.TCPPort)))
+	}
+	return addrs, nil
+}
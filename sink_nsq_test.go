@@ -0,0 +1,193 @@
+package mysql2nsq
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeProducer struct {
+	addr string
+	down bool
+	log  *[]string
+}
+
+func (p *fakeProducer) Publish(topic string, body []byte) error {
+	if p.down {
+		return errors.New("connection refused")
+	}
+	*p.log = append(*p.log, p.addr+"/"+topic+":"+string(body))
+	return nil
+}
+
+func (p *fakeProducer) MultiPublish(topic string, bodies [][]byte) error {
+	for _, body := range bodies {
+		if err := p.Publish(topic, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *fakeProducer) Ping() error {
+	if p.down {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (p *fakeProducer) Stop() {}
+
+type fakeNsqd struct {
+	lock      sync.Mutex
+	published []string
+	producers map[string]*fakeProducer
+}
+
+func newFakeNsqd() *fakeNsqd {
+	return &fakeNsqd{producers: make(map[string]*fakeProducer)}
+}
+
+func (f *fakeNsqd) newProducer(addr string) (nsqProducer, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	p, ok := f.producers[addr]
+	if !ok {
+		p = &fakeProducer{addr: addr, log: &f.published}
+		f.producers[addr] = p
+	}
+	return p, nil
+}
+
+func (f *fakeNsqd) setDown(addr string, down bool) {
+	p, _ := f.newProducer(addr)
+	p.(*fakeProducer).down = down
+}
+
+func TestNsqSinkStickyFailover(t *testing.T) {
+	f := newFakeNsqd()
+	s, err := newNsqSinkWithProducer(NsqConfig{NsqdAddrs: []string{"nsqd1:4150", "nsqd2:4150"}}, f.newProducer)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.Nil(t, s.Publish(&Message{Topic: "db1", Body: []byte("1")}))
+	assert.Nil(t, s.Publish(&Message{Topic: "db1", Body: []byte("2")}))
+
+	f.setDown("nsqd1:4150", true)
+	assert.Nil(t, s.Publish(&Message{Topic: "db1", Body: []byte("3")}))
+
+	// nsqd1恢复后仍然使用nsqd2
+	f.setDown("nsqd1:4150", false)
+	s.checkUnhealthy()
+	assert.Nil(t, s.PublishBatch([]*Message{{Topic: "db1", Body: []byte("4")}, {Topic: "db1", Body: []byte("5")}}))
+
+	assert.Equal(t, []string{
+		"nsqd1:4150/db1:1",
+		"nsqd1:4150/db1:2",
+		"nsqd2:4150/db1:3",
+		"nsqd2:4150/db1:4",
+		"nsqd2:4150/db1:5",
+	}, f.published)
+
+	// 都不可用时返回错误
+	f.setDown("nsqd1:4150", true)
+	f.setDown("nsqd2:4150", true)
+	assert.NotNil(t, s.Publish(&Message{Topic: "db1", Body: []byte("6")}))
+
+	// 之后再全部试一次
+	f.setDown("nsqd1:4150", false)
+	assert.Nil(t, s.Publish(&Message{Topic: "db1", Body: []byte("7")}))
+	assert.Equal(t, "nsqd1:4150/db1:7", f.published[len(f.published)-1])
+}
+
+func TestNsqSinkRoundRobin(t *testing.T) {
+	f := newFakeNsqd()
+	s, err := newNsqSinkWithProducer(NsqConfig{NsqdAddrs: []string{"nsqd1:4150", "nsqd2:4150"}, Strategy: NsqStrategyRoundRobin}, f.newProducer)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	for _, body := range []string{"1", "2", "3"} {
+		assert.Nil(t, s.Publish(&Message{Topic: "db1", Body: []byte(body)}))
+	}
+	assert.Equal(t, []string{"nsqd1:4150/db1:1", "nsqd2:4150/db1:2", "nsqd1:4150/db1:3"}, f.published)
+
+	_, err = newNsqSinkWithProducer(NsqConfig{NsqdAddrs: []string{"nsqd1:4150"}, Strategy: "random"}, f.newProducer)
+	assert.NotNil(t, err)
+}
+
+func TestNsqSinkPing(t *testing.T) {
+	f := newFakeNsqd()
+	s, err := newNsqSinkWithProducer(NsqConfig{NsqdAddrs: []string{"nsqd1:4150", "nsqd2:4150"}, Strategy: NsqStrategyRoundRobin}, f.newProducer)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	// 不轮换nsqd
+	assert.Nil(t, s.Publish(&Message{Topic: "db1", Body: []byte("1")}))
+	assert.Nil(t, s.Ping())
+	assert.Nil(t, s.Ping())
+	assert.Nil(t, s.Publish(&Message{Topic: "db1", Body: []byte("2")}))
+	assert.Equal(t, []string{"nsqd1:4150/db1:1", "nsqd2:4150/db1:2"}, f.published)
+
+	// 失败时不切换nsqd，也不标记不可用
+	f.setDown("nsqd2:4150", true)
+	assert.NotNil(t, s.Ping())
+	assert.Equal(t, "nsqd2:4150", s.current)
+	assert.Equal(t, 0, len(s.unhealthy))
+
+	// 当前的nsqd已经不可用时检查下一个
+	s.unhealthy["nsqd2:4150"] = true
+	assert.Nil(t, s.Ping())
+	assert.Equal(t, "nsqd2:4150", s.current)
+	s.unhealthy["nsqd1:4150"] = true
+	assert.NotNil(t, s.Ping())
+	assert.Equal(t, 2, len(s.unhealthy))
+}
+
+func TestNsqSinkLookupd(t *testing.T) {
+	nodes := `{"producers":[{"broadcast_address":"nsqd3","tcp_port":4150}]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/nodes", r.URL.Path)
+		w.Write([]byte(nodes))
+	}))
+	defer server.Close()
+
+	f := newFakeNsqd()
+	s, err := newNsqSinkWithProducer(NsqConfig{NsqdAddrs: []string{"nsqd1:4150"}, LookupdHTTPAddrs: []string{server.URL}}, f.newProducer)
+	assert.Nil(t, err)
+	defer s.Close()
+	assert.Equal(t, []string{"nsqd1:4150", "nsqd3:4150"}, s.addrs)
+
+	// 旧版本的格式
+	nodes = `{"status_code":200,"status_txt":"OK","data":{"producers":[{"broadcast_address":"nsqd4","tcp_port":4150}]}}`
+	s.discover()
+	assert.Equal(t, []string{"nsqd1:4150", "nsqd4:4150"}, s.addrs)
+
+	// 查询失败时保留原来的nsqd
+	server.Close()
+	s.discover()
+	assert.Equal(t, []string{"nsqd1:4150", "nsqd4:4150"}, s.addrs)
+
+	_, err = newNsqSinkWithProducer(NsqConfig{}, f.newProducer)
+	assert.NotNil(t, err)
+}
+
+func TestNsqSinkReload(t *testing.T) {
+	f := newFakeNsqd()
+	s, err := newNsqSinkWithProducer(NsqConfig{NsqdAddrs: []string{"nsqd1:4150"}}, f.newProducer)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.Nil(t, s.Publish(&Message{Topic: "db1", Body: []byte("1")}))
+
+	assert.NotNil(t, s.Reload(Config{Nsq: NsqConfig{NsqdAddrs: []string{"nsqd2:4150"}, Strategy: "random"}}))
+	assert.Nil(t, s.Reload(Config{NsqdAddr: "nsqd2:4150"}))
+	assert.Equal(t, []string{"nsqd2:4150"}, s.addrs)
+
+	assert.Nil(t, s.Publish(&Message{Topic: "db1", Body: []byte("2")}))
+	assert.Equal(t, []string{"nsqd1:4150/db1:1", "nsqd2:4150/db1:2"}, f.published)
+}
@@ -0,0 +1,577 @@
+package mysql2nsq
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/siddontang/go-log/log"
+)
+
+// ErrSpoolFull 表示spool达到了大小或时间的上限，不能再写入
+var ErrSpoolFull = errors.New("spool is full")
+
+// ErrSpoolClosed 表示spool已经关闭
+var ErrSpoolClosed = errors.New("spool is closed")
+
+const (
+	spoolSegmentExt = ".seg"
+	// spoolOffsetFile 记录正在投递的段和段中下一条记录的位置："序号 位置"
+	spoolOffsetFile = "drain.offset"
+	// 记录头：payload长度 4字节 + payload的CRC32 4字节
+	spoolRecordHeaderSize = 8
+)
+
+var (
+	metricSpoolBytes    = newGauge("mysql2nsq_spool_bytes", "本地spool中还没有投递的数据大小")
+	metricSpoolSpooled  = newCounter("mysql2nsq_spool_spooled_total", "写入本地spool的消息数")
+	metricSpoolDrained  = newCounter("mysql2nsq_spool_drained_total", "从本地spool投递出去的消息数")
+	metricSpoolSegments = newGauge("mysql2nsq_spool_segments", "本地spool的段文件数")
+)
+
+// SpoolSink 在inner不可用时把消息写入本地磁盘，inner恢复后按顺序投递出去
+//
+// spool中有数据时，新消息也写入spool，保证消息的顺序
+// Flush 会把spool fsync到磁盘，所以更新GTIDSet时消息要么已经送达，要么已经安全地写入了spool
+// spool由多个段文件组成，每个段投递完后删除；达到大小或时间上限后 Publish 返回 ErrSpoolFull，
+// 调用方会按重试策略暂停同步
+//
+// 每条消息投递给inner并且inner的Flush成功后，才把投递的位置写入drain.offset，重启后从该位置继续投递
+// 该文件不fsync，断电时最后送达的一些消息可能再投递一次，所以spool的投递是至少一次的
+// spool中的消息读出时没有 Message.Data
+type SpoolSink struct {
+	inner  Sink
+	config SpoolConfig
+	retry  RetryConfig
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	// segments 是还没有投递完的段，最旧的在前，active 是最后一个段的写入文件
+	segments []*spoolSegment
+	active   *os.File
+	nextSeq  uint64
+	size     int64
+	// oldest 是最旧的未投递消息写入spool的时间
+	oldest time.Time
+	// direct 表示上次Flush后有消息直接投递给了inner
+	direct bool
+
+	// reader 是正在投递的段（segments[0]）的读取文件，readOffset 是下一条记录的位置
+	reader     *os.File
+	readOffset int64
+	// offsetFile 持久化readOffset
+	offsetFile *os.File
+
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type spoolSegment struct {
+	seq  uint64
+	path string
+	size int64
+}
+
+type spoolRecord struct {
+	msg     *Message
+	created time.Time
+	size    int64
+}
+
+// NewSpoolSink 打开config.Dir中的spool，并开始投递其中的消息
+// retry 用于投递失败时的等待间隔，spool中的消息会一直重试
+func NewSpoolSink(inner Sink, config SpoolConfig, retry RetryConfig) (*SpoolSink, error) {
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	segments, err := readSpoolSegments(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	retry.MaxAttempts = 0
+	s := &SpoolSink{
+		inner:    inner,
+		config:   config,
+		retry:    retry,
+		segments: segments,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.lock)
+	for _, seg := range segments {
+		s.size += seg.size
+		s.nextSeq = seg.seq + 1
+	}
+	if err = s.openOffset(); err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		s.oldest = time.Now()
+		log.Infof("spool中有%d个段，共%d字节待投递\n", len(segments), s.size-s.readOffset)
+	}
+	s.updateMetrics()
+
+	go s.drain()
+
+	return s, nil
+}
+
+// openOffset 打开drain.offset，记录的段还在时从记录的位置继续投递
+func (s *SpoolSink) openOffset() error {
+	path := filepath.Join(s.config.Dir, spoolOffsetFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err = syncDir(s.config.Dir); err != nil {
+		f.Close()
+		return err
+	}
+	s.offsetFile = f
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	var seq uint64
+	var offset int64
+	if _, err = fmt.Sscanf(string(b), "%d %d", &seq, &offset); err != nil {
+		return nil
+	}
+	if len(s.segments) > 0 && s.segments[0].seq == seq && offset >= 0 && offset <= s.segments[0].size {
+		s.readOffset = offset
+	}
+	return nil
+}
+
+// saveOffset 把readOffset写入drain.offset，失败时只会导致重启后重复投递，调用时需持有锁
+func (s *SpoolSink) saveOffset() {
+	b := []byte(fmt.Sprintf("%d %d", s.segments[0].seq, s.readOffset))
+	_, err := s.offsetFile.WriteAt(b, 0)
+	if err == nil {
+		err = s.offsetFile.Truncate(int64(len(b)))
+	}
+	if err != nil {
+		log.Warnf("记录spool投递位置失败，重启后可能重复投递: %s\n", err)
+	}
+}
+
+// syncDir fsync目录，使其中新建或删除的文件在断电后仍然有效
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+func readSpoolSegments(dir string) ([]*spoolSegment, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*spoolSegment
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, &spoolSegment{seq: seq, path: filepath.Join(dir, name), size: info.Size()})
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+	return segments, nil
+}
+
+// Publish implement Sink
+// spool为空时直接投递给inner，失败时写入spool
+func (s *SpoolSink) Publish(msg *Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrSpoolClosed
+	}
+
+	if len(s.segments) == 0 {
+		// spool为空时只有调用方会投递，不会和drain同时投递
+		err := s.inner.Publish(msg)
+		if err == nil {
+			s.direct = true
+			return nil
+		}
+		log.Warnf("投递失败，写入spool: %s\n", err)
+	}
+
+	return s.append(msg)
+}
+
+// PublishBatch implement Sink
+func (s *SpoolSink) PublishBatch(msgs []*Message) error {
+	for _, msg := range msgs {
+		if err := s.Publish(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush implement Sink
+// 把spool写入磁盘，并Flush直接投递过的inner
+func (s *SpoolSink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.active != nil {
+		if err := s.active.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if s.direct {
+		if err := s.inner.Flush(); err != nil {
+			return err
+		}
+		s.direct = false
+	}
+
+	return nil
+}
+
+// Ping implement Pinger
+func (s *SpoolSink) Ping() error {
+	if p, ok := s.inner.(Pinger); ok {
+		return p.Ping()
+	}
+	return nil
+}
+
+// Reload implement Reloader
+func (s *SpoolSink) Reload(config Config) error {
+	if r, ok := s.inner.(Reloader); ok {
+		return r.Reload(config)
+	}
+	return nil
+}
+
+// Close implement Sink
+// 没有投递完的消息留在磁盘上，下次启动时继续投递
+func (s *SpoolSink) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	<-s.done
+
+	s.lock.Lock()
+	var err error
+	if s.active != nil {
+		err = s.active.Sync()
+		s.active.Close()
+		s.active = nil
+	}
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	s.offsetFile.Close()
+	s.lock.Unlock()
+
+	if e := s.inner.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// append 把消息写入最后一个段，调用时需持有锁
+func (s *SpoolSink) append(msg *Message) error {
+	if s.config.MaxSize > 0 && s.size-s.readOffset >= s.config.MaxSize*1024*1024 {
+		return ErrSpoolFull
+	}
+	if s.config.MaxAge.Duration > 0 && !s.oldest.IsZero() && time.Since(s.oldest) > s.config.MaxAge.Duration {
+		return ErrSpoolFull
+	}
+
+	if s.active == nil || s.segments[len(s.segments)-1].size >= s.config.segmentSize() {
+		if err := s.roll(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	bs := encodeSpoolRecord(msg, now)
+	seg := s.segments[len(s.segments)-1]
+	if _, err := s.active.Write(bs); err != nil {
+		// 写了一部分的记录会被读取时忽略，之后写到新的段里
+		s.active.Close()
+		s.active = nil
+		return fmt.Errorf("write spool failed: %s", err)
+	}
+
+	seg.size += int64(len(bs))
+	s.size += int64(len(bs))
+	if s.oldest.IsZero() {
+		s.oldest = now
+	}
+	metricSpoolSpooled.Inc()
+	s.updateMetrics()
+	s.cond.Broadcast()
+
+	return nil
+}
+
+// roll 创建新的段，调用时需持有锁
+func (s *SpoolSink) roll() error {
+	if s.active != nil {
+		if err := s.active.Sync(); err != nil {
+			return err
+		}
+		s.active.Close()
+		s.active = nil
+	}
+
+	seg := &spoolSegment{
+		seq:  s.nextSeq,
+		path: filepath.Join(s.config.Dir, fmt.Sprintf("%020d%s", s.nextSeq, spoolSegmentExt)),
+	}
+	f, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	// 新的段要在目录中持久化，否则断电后Flush过的记录会随段一起消失
+	if err = syncDir(s.config.Dir); err != nil {
+		f.Close()
+		os.Remove(seg.path)
+		return err
+	}
+
+	s.nextSeq++
+	s.active = f
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+// drain 按顺序投递spool中的消息，直到Close
+func (s *SpoolSink) drain() {
+	defer close(s.done)
+
+	for {
+		rec, ok := s.next()
+		if !ok {
+			return
+		}
+
+		backoff := NewBackoff(s.retry)
+		for {
+			// Publish返回nil不代表已经送达，Flush成功后才能记录位置和删除段
+			err := s.inner.Publish(rec.msg)
+			if err == nil {
+				if err = s.inner.Flush(); err == nil {
+					break
+				}
+			}
+
+			wait, _ := backoff.Next()
+			log.Warnf("投递spool中的消息失败，%s后重试: %s\n", wait, err)
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		s.ack(rec)
+	}
+}
+
+// next 返回下一条要投递的消息，没有时等待，Close后返回false
+func (s *SpoolSink) next() (*spoolRecord, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for {
+		if s.closed {
+			return nil, false
+		}
+
+		if len(s.segments) == 0 {
+			s.cond.Wait()
+			continue
+		}
+
+		seg := s.segments[0]
+		if s.readOffset >= seg.size {
+			// 段中的消息都投递了，删除该段，spool空了之后新的消息直接投递
+			s.removeHead()
+			continue
+		}
+
+		rec, err := s.readRecord(seg)
+		if err != nil {
+			// 段末尾不完整的记录，通常是写入时进程退出了，之后的数据都不可用
+			log.Warnf("读取spool %s 失败，忽略该段剩余的%d字节: %s\n", seg.path, seg.size-s.readOffset, err)
+			s.size -= seg.size - s.readOffset
+			seg.size = s.readOffset
+			if seg == s.segments[len(s.segments)-1] && s.active != nil {
+				// 不再往该段写入
+				s.active.Close()
+				s.active = nil
+			}
+			s.updateMetrics()
+			continue
+		}
+
+		s.oldest = rec.created
+		return rec, true
+	}
+}
+
+// readRecord 读取seg中readOffset位置的记录，调用时需持有锁
+func (s *SpoolSink) readRecord(seg *spoolSegment) (*spoolRecord, error) {
+	if s.reader == nil {
+		f, err := os.Open(seg.path)
+		if err != nil {
+			return nil, err
+		}
+		s.reader = f
+	}
+
+	header := make([]byte, spoolRecordHeaderSize)
+	if _, err := s.reader.ReadAt(header, s.readOffset); err != nil {
+		return nil, err
+	}
+
+	n := int64(binary.BigEndian.Uint32(header[0:4]))
+	if s.readOffset+spoolRecordHeaderSize+n > seg.size {
+		return nil, fmt.Errorf("record length %d out of segment", n)
+	}
+
+	payload := make([]byte, n)
+	if _, err := s.reader.ReadAt(payload, s.readOffset+spoolRecordHeaderSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	rec, err := decodeSpoolRecord(payload)
+	if err != nil {
+		return nil, err
+	}
+	rec.size = spoolRecordHeaderSize + n
+	return rec, nil
+}
+
+// removeHead 删除已经投递完的第一个段，调用时需持有锁
+func (s *SpoolSink) removeHead() {
+	seg := s.segments[0]
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	if len(s.segments) == 1 && s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+
+	if err := os.Remove(seg.path); err != nil {
+		log.Errorf("删除spool段失败 %s: %s\n", seg.path, err)
+	} else if err = syncDir(s.config.Dir); err != nil {
+		// 删除没有持久化时，重启后该段会再投递一次
+		log.Warnf("fsync spool目录失败 %s: %s\n", s.config.Dir, err)
+	}
+
+	s.segments = s.segments[1:]
+	s.size -= seg.size
+	s.readOffset = 0
+	if len(s.segments) == 0 {
+		s.oldest = time.Time{}
+		log.Infof("spool中的消息已经全部投递\n")
+	}
+	s.updateMetrics()
+}
+
+// ack 在rec投递给inner并且Flush成功后调用
+func (s *SpoolSink) ack(rec *spoolRecord) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.readOffset += rec.size
+	s.saveOffset()
+	metricSpoolDrained.Inc()
+	s.updateMetrics()
+}
+
+// Len 返回spool中还没有投递的数据大小
+func (s *SpoolSink) Len() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.size - s.readOffset
+}
+
+func (s *SpoolSink) updateMetrics() {
+	metricSpoolBytes.Set(float64(s.size - s.readOffset))
+	metricSpoolSegments.Set(float64(len(s.segments)))
+}
+
+// encodeSpoolRecord 编码一条记录
+// payload：写入时间 8字节 + topic长度 2字节 + topic + body
+func encodeSpoolRecord(msg *Message, created time.Time) []byte {
+	n := 8 + 2 + len(msg.Topic) + len(msg.Body)
+	bs := make([]byte, spoolRecordHeaderSize+n)
+	payload := bs[spoolRecordHeaderSize:]
+
+	binary.BigEndian.PutUint64(payload[0:8], uint64(created.UnixNano()))
+	binary.BigEndian.PutUint16(payload[8:10], uint16(len(msg.Topic)))
+	copy(payload[10:], msg.Topic)
+	copy(payload[10+len(msg.Topic):], msg.Body)
+
+	binary.BigEndian.PutUint32(bs[0:4], uint32(n))
+	binary.BigEndian.PutUint32(bs[4:8], crc32.ChecksumIEEE(payload))
+	return bs
+}
+
+func decodeSpoolRecord(payload []byte) (*spoolRecord, error) {
+	if len(payload) < 10 {
+		return nil, errors.New("record too short")
+	}
+	created := time.Unix(0, int64(binary.BigEndian.Uint64(payload[0:8])))
+	topicLen := int(binary.BigEndian.Uint16(payload[8:10]))
+	if len(payload) < 10+topicLen {
+		return nil, errors.New("record too short")
+	}
+
+	return &spoolRecord{
+		msg: &Message{
+			Topic: string(payload[10 : 10+topicLen]),
+			Body:  payload[10+topicLen:],
+		},
+		created: created,
+	}, nil
+}
@@ -0,0 +1,296 @@
+package mysql2nsq
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncSink 是可以并发使用的memSink，limit大于0时最多接收limit条消息
+type syncSink struct {
+	lock  sync.Mutex
+	down  bool
+	limit int
+	msgs  []string
+}
+
+// waitFor 等待condition成立，最多等1秒
+// testify 1.4.0的assert.Eventually返回后检查的goroutine可能向已关闭的channel发送导致panic，这里自己轮询
+func waitFor(t *testing.T, condition func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return assert.Fail(t, "condition never satisfied")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+func (s *syncSink) setDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.down = down
+}
+
+func (s *syncSink) bodies() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.msgs...)
+}
+
+func (s *syncSink) Publish(msg *Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.down || (s.limit > 0 && len(s.msgs) >= s.limit) {
+		return errors.New("nsqd down")
+	}
+	s.msgs = append(s.msgs, msg.Topic+":"+string(msg.Body))
+	return nil
+}
+
+func (s *syncSink) PublishBatch(msgs []*Message) error {
+	for _, msg := range msgs {
+		if err := s.Publish(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syncSink) Flush() error {
+	return nil
+}
+
+func (s *syncSink) Close() error {
+	return nil
+}
+
+// bufferSink 在Flush前只缓存消息，flushDown为true时Flush失败并丢掉缓存的消息
+type bufferSink struct {
+	syncSink
+	flushDown bool
+	buffered  []string
+}
+
+func (s *bufferSink) setFlushDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.flushDown = down
+}
+
+func (s *bufferSink) Publish(msg *Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.down {
+		return errors.New("nsqd down")
+	}
+	s.buffered = append(s.buffered, msg.Topic+":"+string(msg.Body))
+	return nil
+}
+
+func (s *bufferSink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	buffered := s.buffered
+	s.buffered = nil
+	if s.flushDown {
+		return errors.New("flush failed")
+	}
+	s.msgs = append(s.msgs, buffered...)
+	return nil
+}
+
+func testSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.Nil(t, err)
+	return dir
+}
+
+var testSpoolRetry = RetryConfig{InitialInterval: Duration{time.Millisecond}, MaxInterval: Duration{10 * time.Millisecond}}
+
+func spoolMessage(body string) *Message {
+	return &Message{Topic: "db1", Body: []byte(body)}
+}
+
+func TestSpoolSinkDrainInOrder(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &syncSink{}
+	s, err := NewSpoolSink(inner, SpoolConfig{Dir: dir}, testSpoolRetry)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.Nil(t, s.Publish(spoolMessage("1")))
+
+	inner.setDown(true)
+	assert.Nil(t, s.Publish(spoolMessage("2")))
+	assert.Nil(t, s.Publish(spoolMessage("3")))
+	assert.Nil(t, s.Flush())
+	assert.True(t, s.Len() > 0)
+
+	inner.setDown(false)
+	// spool中还有数据时，新消息排在后面
+	assert.Nil(t, s.Publish(spoolMessage("4")))
+
+	waitFor(t, func() bool { return s.Len() == 0 && len(inner.bodies()) == 4 })
+	assert.Equal(t, []string{"db1:1", "db1:2", "db1:3", "db1:4"}, inner.bodies())
+
+	// 投递完后段文件被删除，新消息直接投递
+	waitFor(t, func() bool {
+		segments, _ := readSpoolSegments(dir)
+		return len(segments) == 0
+	})
+	assert.Nil(t, s.Publish(spoolMessage("5")))
+	assert.Equal(t, "db1:5", inner.bodies()[4])
+}
+
+func TestSpoolSinkResumeAfterRestart(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &syncSink{down: true}
+	s, err := NewSpoolSink(inner, SpoolConfig{Dir: dir}, testSpoolRetry)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Publish(spoolMessage("1")))
+	assert.Nil(t, s.Publish(spoolMessage("2")))
+	assert.Nil(t, s.Flush())
+	assert.Nil(t, s.Close())
+
+	// 模拟写入一半时进程退出
+	segments, err := readSpoolSegments(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(segments))
+	f, err := os.OpenFile(segments[0].path, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.Nil(t, err)
+	_, err = f.Write(encodeSpoolRecord(spoolMessage("3"), time.Now())[:10])
+	assert.Nil(t, err)
+	f.Close()
+
+	inner = &syncSink{}
+	s, err = NewSpoolSink(inner, SpoolConfig{Dir: dir}, testSpoolRetry)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	waitFor(t, func() bool { return s.Len() == 0 })
+	assert.Equal(t, []string{"db1:1", "db1:2"}, inner.bodies())
+	_, err = os.Stat(segments[0].path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSpoolSinkResumeFromOffset(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &syncSink{down: true, limit: 2}
+	s, err := NewSpoolSink(inner, SpoolConfig{Dir: dir}, testSpoolRetry)
+	assert.Nil(t, err)
+	for _, body := range []string{"1", "2", "3"} {
+		assert.Nil(t, s.Publish(spoolMessage(body)))
+	}
+	assert.Nil(t, s.Flush())
+
+	// 投递了两条后退出
+	inner.setDown(false)
+	waitFor(t, func() bool { return len(inner.bodies()) == 2 })
+	assert.Nil(t, s.Close())
+
+	// 重启后不再投递已经送达的消息
+	inner = &syncSink{}
+	s, err = NewSpoolSink(inner, SpoolConfig{Dir: dir}, testSpoolRetry)
+	assert.Nil(t, err)
+	defer s.Close()
+	waitFor(t, func() bool { return s.Len() == 0 })
+	assert.Equal(t, []string{"db1:3"}, inner.bodies())
+}
+
+func TestSpoolSinkFlushBeforeAck(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &bufferSink{syncSink: syncSink{down: true}, flushDown: true}
+	s, err := NewSpoolSink(inner, SpoolConfig{Dir: dir}, testSpoolRetry)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Publish(spoolMessage("1")))
+	assert.Nil(t, s.Publish(spoolMessage("2")))
+	assert.Nil(t, s.Flush())
+
+	// inner接受了消息，但是Flush一直失败，不能记录投递位置或删除段
+	inner.setDown(false)
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, s.Len() > 0)
+	assert.Empty(t, inner.bodies())
+	assert.Nil(t, s.Close())
+
+	// 重启后重新投递
+	inner = &bufferSink{}
+	s, err = NewSpoolSink(inner, SpoolConfig{Dir: dir}, testSpoolRetry)
+	assert.Nil(t, err)
+	defer s.Close()
+	waitFor(t, func() bool { return s.Len() == 0 })
+	assert.Equal(t, []string{"db1:1", "db1:2"}, inner.bodies())
+
+	// Flush恢复后投递位置继续前进
+	inner.setDown(true)
+	assert.Nil(t, s.Publish(spoolMessage("3")))
+	inner.setFlushDown(true)
+	inner.setDown(false)
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, s.Len() > 0)
+	inner.setFlushDown(false)
+	waitFor(t, func() bool { return s.Len() == 0 })
+	assert.Equal(t, []string{"db1:1", "db1:2", "db1:3"}, inner.bodies())
+}
+
+func TestSpoolSinkSegments(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &syncSink{down: true}
+	s, err := NewSpoolSink(inner, SpoolConfig{Dir: dir}, testSpoolRetry)
+	assert.Nil(t, err)
+	defer s.Close()
+	// 每条消息一个段
+	s.config.SegmentSize = 0
+	s.lock.Lock()
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, s.append(spoolMessage("x")))
+		assert.Nil(t, s.roll())
+	}
+	s.lock.Unlock()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	assert.Equal(t, 4, len(files))
+
+	inner.setDown(false)
+	waitFor(t, func() bool {
+		files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+		return len(files) == 0
+	})
+	assert.Equal(t, []string{"db1:x", "db1:x", "db1:x"}, inner.bodies())
+}
+
+func TestSpoolSinkLimits(t *testing.T) {
+	dir := testSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	inner := &syncSink{down: true}
+	s, err := NewSpoolSink(inner, SpoolConfig{Dir: dir, MaxAge: Duration{time.Millisecond}}, testSpoolRetry)
+	assert.Nil(t, err)
+	defer s.Close()
+
+	assert.Nil(t, s.Publish(spoolMessage("1")))
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, ErrSpoolFull, s.Publish(spoolMessage("2")))
+
+	s.config = SpoolConfig{Dir: dir, MaxSize: 1}
+	assert.Nil(t, s.Publish(spoolMessage(string(make([]byte, 1024*1024)))))
+	assert.Equal(t, ErrSpoolFull, s.Publish(spoolMessage("3")))
+}
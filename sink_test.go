@@ -0,0 +1,26 @@
+package mysql2nsq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSink(t *testing.T) {
+	_, err := NewSink(Config{Sink: SinkConfig{Type: "unknown"}})
+	assert.NotNil(t, err)
+
+	RegisterSink("mem", func(config Config) (Sink, error) {
+		return &memSink{}, nil
+	})
+
+	sink, err := NewSink(Config{Sink: SinkConfig{Type: "mem"}})
+	assert.Nil(t, err)
+	assert.IsType(t, &memSink{}, sink)
+
+	// 默认是nsq
+	sink, err = NewSink(Config{NsqdAddr: "127.0.0.1:4150"})
+	assert.Nil(t, err)
+	assert.IsType(t, &nsqSink{}, sink)
+	sink.Close()
+}
@@ -0,0 +1,422 @@
+package mysql2nsq
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// Snapshotter 在同步binlog之前，把要同步的表中已有的行作为READ发布出去
+//
+// 在一个一致性快照（START TRANSACTION WITH CONSISTENT SNAPSHOT）事务中按主键分块读取每张表，
+// 每块数据发布成功后把进度写入文件，进程中断后从下一块继续
+// 继续时会开始一个新的快照事务，但仍然从第一次记录的GTIDSet开始同步binlog，期间的变化不会丢失，只会重复
+// 没有主键的表不能分块读取，快照会失败
+type Snapshotter struct {
+	config SnapshotConfig
+	tmm    *TableMetaManager
+	path   string
+	state  snapshotState
+
+	// open 打开读取快照的连接，测试时替换
+	open func(ctx context.Context) (snapshotConn, error)
+}
+
+// snapshotState 是快照的进度
+type snapshotState struct {
+	// GTIDSet 是第一次开始快照时的gtid_executed，从中断处继续时不变
+	GTIDSet   string
+	StartedAt time.Time
+	// Tables 是要做快照的表，第一次开始快照时确定
+	Tables []TableRef
+	// Table 是正在读取的表在Tables中的下标
+	Table int
+	// LastKey 是正在读取的表中已经发布的最后一行的主键
+	LastKey []interface{} `json:",omitempty"`
+	Done    bool
+}
+
+// chunkReader 按主键分块读取数据
+type chunkReader interface {
+	// readChunk 按主键顺序返回主键大于after的最多limit行，after为nil时从第一行开始，where不为空时只返回满足条件的行
+	readChunk(ctx context.Context, schemaName string, table *Table, after []interface{}, where string, limit int) ([]map[string]interface{}, error)
+}
+
+// snapshotConn 是读取快照的mysql连接
+type snapshotConn interface {
+	chunkReader
+	// begin 开始一致性快照事务，返回快照时的gtid_executed
+	begin(ctx context.Context, lock bool) (string, error)
+	close() error
+}
+
+// NewSnapshotter 返回Snapshotter实例
+// db 用来读取快照，tmm 提供要同步的表和表结构，statePath 是进度文件的路径
+func NewSnapshotter(db *sql.DB, tmm *TableMetaManager, config SnapshotConfig, statePath string) (*Snapshotter, error) {
+	s := &Snapshotter{
+		config: config,
+		tmm:    tmm,
+		path:   statePath,
+		open: func(ctx context.Context) (snapshotConn, error) {
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return &sqlSnapshotConn{conn: conn}, nil
+		},
+	}
+
+	state, err := readSnapshotState(statePath)
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot state %s failed: %s", statePath, err)
+	}
+	s.state = state
+
+	return s, nil
+}
+
+// Done 返回快照是否已经完成
+func (s *Snapshotter) Done() bool {
+	return s.state.Done
+}
+
+// Run 读取所有表，每块数据调用一次publish，publish返回nil后记录进度
+// 返回应该开始同步binlog的GTIDSet
+func (s *Snapshotter) Run(ctx context.Context, publish func(dc *DataChanged) error) (mysql.GTIDSet, error) {
+	conn, err := s.open(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect failed: %s", err)
+	}
+	defer conn.close()
+
+	GTIDSet, err := conn.begin(ctx, s.config.Lock)
+	if err != nil {
+		return nil, fmt.Errorf("start consistent snapshot failed: %s", err)
+	}
+
+	if s.state.GTIDSet == "" {
+		s.state = snapshotState{GTIDSet: GTIDSet, StartedAt: time.Now(), Tables: s.tmm.Tables()}
+		if err = s.save(); err != nil {
+			return nil, err
+		}
+		log.Infof("开始快照，GTIDSet: %s\n", GTIDSet)
+	} else {
+		log.Infof("继续快照，GTIDSet: %s，已完成%d/%d张表\n", s.state.GTIDSet, s.state.Table, len(s.state.Tables))
+	}
+
+	chunkSize := s.config.chunkSize()
+	for s.state.Table < len(s.state.Tables) {
+		ref := s.state.Tables[s.state.Table]
+		table, err := s.tmm.Query(ref.Schema, ref.Table)
+		if err != nil {
+			log.Warnf("快照时没有找到表%s.%s，跳过: %s\n", ref.Schema, ref.Table, err)
+		} else if len(table.PrimaryKey) == 0 {
+			return nil, fmt.Errorf("表%s.%s没有主键，不能分块读取", ref.Schema, ref.Table)
+		}
+
+		for table != nil {
+			rows, err := conn.readChunk(ctx, ref.Schema, table, s.state.LastKey, "", chunkSize)
+			if err != nil {
+				return nil, fmt.Errorf("read %s.%s failed: %s", ref.Schema, ref.Table, err)
+			}
+			if len(rows) == 0 {
+				break
+			}
+
+			if err = publish(snapshotDataChanged(ref.Schema, table, rows, READ, s.state.StartedAt)); err != nil {
+				return nil, err
+			}
+			metricSnapshotRows.Add(float64(len(rows)))
+
+			s.state.LastKey = chunkKey(table.PrimaryKey, rows[len(rows)-1])
+			if err = s.save(); err != nil {
+				return nil, err
+			}
+			if len(rows) < chunkSize {
+				break
+			}
+		}
+
+		log.Infof("表%s.%s快照完成\n", ref.Schema, ref.Table)
+		s.state.Table++
+		s.state.LastKey = nil
+		if err = s.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return mysql.ParseMysqlGTIDSet(s.state.GTIDSet)
+}
+
+// Finish 在快照时的GTIDSet写入storage后调用，记录快照已经完成
+func (s *Snapshotter) Finish() error {
+	s.state.Done = true
+	return s.save()
+}
+
+func (s *Snapshotter) save() error {
+	bs, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, bs)
+}
+
+func readSnapshotState(path string) (snapshotState, error) {
+	var state snapshotState
+
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	// 主键中的整数按int64读取，避免超过2^53时丢失精度
+	decoder := json.NewDecoder(bytes.NewReader(bs))
+	decoder.UseNumber()
+	if err = decoder.Decode(&state); err != nil {
+		return state, err
+	}
+	for i, v := range state.LastKey {
+		if n, ok := v.(json.Number); ok {
+			state.LastKey[i] = numberParam(n)
+		}
+	}
+	return state, nil
+}
+
+func numberParam(n json.Number) interface{} {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return i
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return u
+	}
+	return string(n)
+}
+
+// writeFileAtomic 先写入临时文件再改名，中途退出时不会留下写了一半的文件
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// snapshotDataChanged 把读出的行转换成DataChanged
+func snapshotDataChanged(schemaName string, table *Table, rows []map[string]interface{}, action Action, at time.Time) *DataChanged {
+	dc := &DataChanged{
+		Schema:     schemaName,
+		Table:      table.Name,
+		Action:     action,
+		PrimaryKey: table.PrimaryKey,
+		RowImage:   FULL,
+		Source:     Source{Timestamp: at},
+	}
+	for _, row := range rows {
+		dc.Changes = append(dc.Changes, RowChange{After: row, Key: RowKey(table.PrimaryKey, row, nil)})
+	}
+	return dc
+}
+
+// chunkKey 返回row的主键，用作下一块的查询参数
+func chunkKey(primaryKey []string, row map[string]interface{}) []interface{} {
+	key := make([]interface{}, len(primaryKey))
+	for i, name := range primaryKey {
+		switch v := row[name].(type) {
+		case []byte, time.Time:
+			key[i] = keyValue(v)
+		default:
+			key[i] = v
+		}
+	}
+	return key
+}
+
+// sqlSnapshotConn 用database/sql读取快照
+type sqlSnapshotConn struct {
+	conn *sql.Conn
+}
+
+func (c *sqlSnapshotConn) begin(ctx context.Context, lock bool) (string, error) {
+	if _, err := c.conn.ExecContext(ctx, "SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+		return "", err
+	}
+
+	if lock {
+		if _, err := c.conn.ExecContext(ctx, "FLUSH TABLES WITH READ LOCK"); err != nil {
+			return "", err
+		}
+		defer c.conn.ExecContext(context.Background(), "UNLOCK TABLES")
+	}
+
+	var GTIDSet string
+	if err := c.conn.QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_executed").Scan(&GTIDSet); err != nil {
+		return "", err
+	}
+	if _, err := c.conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT"); err != nil {
+		return "", err
+	}
+
+	// 有多个server_uuid时gtid_executed中带有换行
+	return strings.Replace(GTIDSet, "\n", "", -1), nil
+}
+
+func (c *sqlSnapshotConn) readChunk(ctx context.Context, schemaName string, table *Table, after []interface{}, where string, limit int) ([]map[string]interface{}, error) {
+	return readChunk(ctx, c.conn, schemaName, table, after, where, limit)
+}
+
+func (c *sqlSnapshotConn) close() error {
+	// 快照事务是只读的，提交后连接回到连接池
+	c.conn.ExecContext(context.Background(), "COMMIT")
+	return c.conn.Close()
+}
+
+// queryer 是*sql.DB和*sql.Conn共有的查询方法
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// readChunk 按主键顺序读取主键大于after的最多limit行
+func readChunk(ctx context.Context, q queryer, schemaName string, table *Table, after []interface{}, where string, limit int) ([]map[string]interface{}, error) {
+	if len(table.Columns) == 0 {
+		return nil, errors.New("no columns")
+	}
+
+	rows, err := q.QueryContext(ctx, chunkQuery(schemaName, table, after != nil, where, limit), afterArgs(after)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []map[string]interface{}
+	values := make([]interface{}, len(table.Columns))
+	dest := make([]interface{}, len(table.Columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(table.Columns))
+		for i, column := range table.Columns {
+			row[column.ColumnName] = snapshotValue(column, values[i])
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// chunkQuery 返回按主键顺序读取一块数据的SQL，hasAfter为true时带有主键大于参数的条件
+func chunkQuery(schemaName string, table *Table, hasAfter bool, where string, limit int) string {
+	columns := make([]string, len(table.Columns))
+	for i, column := range table.Columns {
+		columns[i] = quoteIdent(column.ColumnName)
+	}
+	primaryKey := make([]string, len(table.PrimaryKey))
+	for i, name := range table.PrimaryKey {
+		primaryKey[i] = quoteIdent(name)
+	}
+
+	var conds []string
+	if hasAfter {
+		// 展开成pk1 > ? OR (pk1 = ? AND pk2 > ?)，mysql 5.6不能对(pk1,pk2) > (?,?)使用索引范围扫描
+		terms := make([]string, len(primaryKey))
+		for i := range primaryKey {
+			var eqs []string
+			for _, name := range primaryKey[:i] {
+				eqs = append(eqs, name+" = ?")
+			}
+			term := primaryKey[i] + " > ?"
+			if i > 0 {
+				term = "(" + strings.Join(append(eqs, term), " AND ") + ")"
+			}
+			terms[i] = term
+		}
+		conds = append(conds, "("+strings.Join(terms, " OR ")+")")
+	}
+	if where != "" {
+		conds = append(conds, "("+where+")")
+	}
+
+	q := fmt.Sprintf("SELECT %s FROM %s.%s", strings.Join(columns, ","), quoteIdent(schemaName), quoteIdent(table.Name))
+	if len(conds) > 0 {
+		q += " WHERE " + strings.Join(conds, " AND ")
+	}
+	return q + fmt.Sprintf(" ORDER BY %s LIMIT %d", strings.Join(primaryKey, ","), limit)
+}
+
+// afterArgs 按chunkQuery展开的条件返回参数，第i个OR条件用到主键的前i+1列
+func afterArgs(after []interface{}) []interface{} {
+	var args []interface{}
+	for i := range after {
+		args = append(args, after[:i+1]...)
+	}
+	return args
+}
+
+func quoteIdent(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// snapshotValue 把database/sql读出的值转换成和binlog中相同的类型
+// 文本协议中所有的值都是[]byte，二进制协议中字符串和数字以外的值是[]byte
+func snapshotValue(c Column, v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		s := string(b)
+		switch c.DataType {
+		case "tinyint", "smallint", "mediumint", "int", "bigint", "year":
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				v = i
+			} else if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+				v = u
+			} else {
+				v = s
+			}
+		case "float", "double", "decimal":
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				v = f
+			} else {
+				v = s
+			}
+		case "binary", "varbinary", "bit", "geometry", "json",
+			"tinyblob", "blob", "mediumblob", "longblob",
+			"tinytext", "text", "mediumtext", "longtext":
+			// binlog中这些类型也是[]byte
+			v = append([]byte(nil), b...)
+		default:
+			v = s
+		}
+	}
+	return c.Format(v)
+}
+
+var metricSnapshotRows = newCounter("mysql2nsq_snapshot_rows_total", "快照发布的行数")
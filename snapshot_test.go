@@ -0,0 +1,178 @@
+package mysql2nsq
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSnapshotConn 从内存中按主键顺序读取db1.user
+type fakeSnapshotConn struct {
+	GTIDSet string
+	rows    []map[string]interface{}
+	queries [][]interface{}
+}
+
+func (c *fakeSnapshotConn) begin(ctx context.Context, lock bool) (string, error) {
+	return c.GTIDSet, nil
+}
+
+func (c *fakeSnapshotConn) readChunk(ctx context.Context, schemaName string, table *Table, after []interface{}, where string, limit int) ([]map[string]interface{}, error) {
+	c.queries = append(c.queries, after)
+
+	var rows []map[string]interface{}
+	for _, row := range c.rows {
+		if after != nil && row["id"].(int64) <= after[0].(int64) {
+			continue
+		}
+		if len(rows) == limit {
+			break
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (c *fakeSnapshotConn) close() error {
+	return nil
+}
+
+func newSnapshotTableMetaManager() *TableMetaManager {
+	tmm := newTestTableMetaManager()
+	tmm.schemas[0].Tables[0].PrimaryKey = []string{"id"}
+	return tmm
+}
+
+func newTestSnapshotter(t *testing.T, path string, conn *fakeSnapshotConn) *Snapshotter {
+	s, err := NewSnapshotter(nil, newSnapshotTableMetaManager(), SnapshotConfig{ChunkSize: 2}, path)
+	assert.Nil(t, err)
+	s.open = func(ctx context.Context) (snapshotConn, error) {
+		return conn, nil
+	}
+	return s
+}
+
+func snapshotRows(n int) []map[string]interface{} {
+	var rows []map[string]interface{}
+	for i := 1; i <= n; i++ {
+		rows = append(rows, map[string]interface{}{"id": int64(i), "name": "user"})
+	}
+	return rows
+}
+
+func TestSnapshotterResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gtidset.db.snapshot")
+
+	const GTIDSet = "36c0fcec-5447-11ea-8dc1-0242ac110002:1-100"
+	conn := &fakeSnapshotConn{GTIDSet: GTIDSet, rows: snapshotRows(5)}
+	s := newTestSnapshotter(t, path, conn)
+
+	// 发布第二块时中断
+	var published []*DataChanged
+	_, err = s.Run(context.Background(), func(dc *DataChanged) error {
+		if len(published) == 1 {
+			return errors.New("nsqd down")
+		}
+		published = append(published, dc)
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(published))
+	assert.Equal(t, READ, published[0].Action)
+	assert.Equal(t, []string{"id"}, published[0].PrimaryKey)
+	assert.Equal(t, "1", published[0].Changes[0].Key)
+	assert.Equal(t, "user", published[0].Changes[1].After["name"])
+
+	// 重启后从下一块继续，GTIDSet仍然是第一次快照时的
+	conn = &fakeSnapshotConn{GTIDSet: "36c0fcec-5447-11ea-8dc1-0242ac110002:1-200", rows: snapshotRows(5)}
+	s = newTestSnapshotter(t, path, conn)
+	assert.False(t, s.Done())
+	set, err := s.Run(context.Background(), func(dc *DataChanged) error {
+		published = append(published, dc)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, GTIDSet, set.String())
+	assert.Equal(t, []interface{}{int64(2)}, conn.queries[0])
+
+	var ids []interface{}
+	for _, dc := range published {
+		for _, c := range dc.Changes {
+			ids = append(ids, c.After["id"])
+		}
+	}
+	assert.Equal(t, []interface{}{int64(1), int64(2), int64(3), int64(4), int64(5)}, ids)
+
+	assert.Nil(t, s.Finish())
+	s = newTestSnapshotter(t, path, conn)
+	assert.True(t, s.Done())
+}
+
+func TestRunnerSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage := &memStorage{}
+	sink := &memSink{}
+	r := NewRunner(Config{Topic: "{schema}.{table}.{action}"}, newSnapshotTableMetaManager(), storage, sink)
+	router, err := NewRouter(r.config, nil)
+	assert.Nil(t, err)
+	r.router = router
+
+	conn := &fakeSnapshotConn{GTIDSet: "36c0fcec-5447-11ea-8dc1-0242ac110002:1-100", rows: snapshotRows(3)}
+	r.SetSnapshotter(newTestSnapshotter(t, filepath.Join(dir, "snapshot"), conn))
+	assert.Nil(t, r.snapshot(context.Background()))
+
+	assert.Equal(t, []string{"db1.user.read", "db1.user.read"}, sink.topics())
+	set, err := storage.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "36c0fcec-5447-11ea-8dc1-0242ac110002:1-100", set.String())
+	assert.True(t, r.snapshotter.Done())
+
+	// 完成后不再做快照
+	assert.Nil(t, r.snapshot(context.Background()))
+	assert.Equal(t, 2, len(sink.msgs))
+}
+
+func TestChunkQuery(t *testing.T) {
+	table := &Table{
+		Name:       "order",
+		Columns:    []Column{{ColumnName: "shop_id"}, {ColumnName: "id"}, {ColumnName: "note`"}},
+		PrimaryKey: []string{"shop_id", "id"},
+	}
+	assert.Equal(t, "SELECT `shop_id`,`id`,`note``` FROM `db1`.`order` ORDER BY `shop_id`,`id` LIMIT 100",
+		chunkQuery("db1", table, false, "", 100))
+	assert.Equal(t, "SELECT `shop_id`,`id`,`note``` FROM `db1`.`order` WHERE (`shop_id` > ? OR (`shop_id` = ? AND `id` > ?)) AND (id > 10) ORDER BY `shop_id`,`id` LIMIT 100",
+		chunkQuery("db1", table, true, "id > 10", 100))
+	assert.Equal(t, []interface{}{1, 1, 2}, afterArgs([]interface{}{1, 2}))
+
+	table.PrimaryKey = []string{"id"}
+	assert.Equal(t, "SELECT `shop_id`,`id`,`note``` FROM `db1`.`order` WHERE (`id` > ?) ORDER BY `id` LIMIT 100",
+		chunkQuery("db1", table, true, "", 100))
+	assert.Equal(t, []interface{}{2}, afterArgs([]interface{}{2}))
+	assert.Nil(t, afterArgs(nil))
+}
+
+func TestSnapshotValue(t *testing.T) {
+	assert.Equal(t, int64(-1), snapshotValue(Column{DataType: "int"}, []byte("-1")))
+	assert.Equal(t, uint64(18446744073709551615), snapshotValue(Column{DataType: "bigint"}, []byte("18446744073709551615")))
+	assert.Equal(t, 1.5, snapshotValue(Column{DataType: "decimal"}, []byte("1.5")))
+	assert.Equal(t, "hiwjd", snapshotValue(Column{DataType: "varchar"}, []byte("hiwjd")))
+	assert.Equal(t, []byte("text"), snapshotValue(Column{DataType: "text"}, []byte("text")))
+	assert.Equal(t, time.Date(2020, 3, 10, 15, 4, 5, 0, time.UTC), snapshotValue(Column{DataType: "datetime"}, []byte("2020-03-10 15:04:05")))
+	assert.Equal(t, int64(7), snapshotValue(Column{DataType: "int"}, int64(7)))
+	assert.Nil(t, snapshotValue(Column{DataType: "int"}, nil))
+
+	// 主键中的整数在进度文件中不丢失精度
+	assert.Equal(t, int64(9007199254740993), numberParam("9007199254740993"))
+}
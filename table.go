@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/mysql"
 )
 
 var (
@@ -15,19 +18,35 @@ var (
 	ErrNotFound = errors.New("table not found")
 )
 
+// TableQuerier 根据库名和表名查找表结构
+type TableQuerier interface {
+	Query(schemaName, tableName string) (*Table, error)
+}
+
 // TableMetaManager 管理表结构
+//
+// 收到DDL时会重新读取受影响的表，读取期间可以并发查询
+// 设置了SchemaHistory时，表结构的每个版本都会被记录下来，查询时可以指定binlog位置
 type TableMetaManager struct {
 	db            *sql.DB
 	schemaConfigs []SchemaConfig
-	schemas       []Schema
+	history       *SchemaHistory
+
+	// updateLock 使重新读取表结构和处理DDL互斥，否则后替换schemas的一方会丢掉另一方的修改
+	// 读取information_schema时只持有updateLock，不影响并发查询
+	updateLock sync.Mutex
+
+	lock    sync.RWMutex
+	schemas []Schema
 }
 
 // NewTableMetaManager 返回TableMetaManager实例
+// db为nil时不读取information_schema，只能使用TableMapEvent中的元数据（binlog_row_metadata=FULL）
 func NewTableMetaManager(db *sql.DB, schemaConfigs []SchemaConfig) (*TableMetaManager, error) {
 	tmm := &TableMetaManager{db: db, schemaConfigs: schemaConfigs}
 
 	var err error
-	if tmm.schemas, err = tmm.buildSchemas(); err != nil {
+	if tmm.schemas, err = tmm.buildSchemas(schemaConfigs); err != nil {
 		return nil, err
 	}
 	log.Infof("tmm.schemas: %+v\n", tmm.schemas)
@@ -36,7 +55,10 @@ func NewTableMetaManager(db *sql.DB, schemaConfigs []SchemaConfig) (*TableMetaMa
 }
 
 // Query 根据库名和表名查找表数据
-func (tmm TableMetaManager) Query(schemaName, tableName string) (*Table, error) {
+func (tmm *TableMetaManager) Query(schemaName, tableName string) (*Table, error) {
+	tmm.lock.RLock()
+	defer tmm.lock.RUnlock()
+
 	for _, sc := range tmm.schemas {
 		if sc.Name == schemaName {
 			for _, tbl := range sc.Tables {
@@ -51,10 +73,239 @@ func (tmm TableMetaManager) Query(schemaName, tableName string) (*Table, error)
 	return nil, ErrNotFound
 }
 
-func (tmm *TableMetaManager) buildSchemas() ([]Schema, error) {
-	q := "SELECT COLUMN_NAME,ORDINAL_POSITION,IS_NULLABLE,DATA_TYPE FROM COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION ASC"
+// Includes 返回表是否在同步的配置中
+func (tmm *TableMetaManager) Includes(schemaName, tableName string) bool {
+	sc, ok := tmm.schemaConfig(schemaName)
+	return ok && sc.includes(tableName)
+}
+
+// Tables 返回所有已经读取了表结构的表
+func (tmm *TableMetaManager) Tables() []TableRef {
+	tmm.lock.RLock()
+	defer tmm.lock.RUnlock()
+
+	var refs []TableRef
+	for _, sc := range tmm.schemas {
+		for _, tbl := range sc.Tables {
+			refs = append(refs, TableRef{Schema: sc.Name, Table: tbl.Name})
+		}
+	}
+	return refs
+}
+
+// Reload 重新读取所有表结构
+func (tmm *TableMetaManager) Reload() error {
+	tmm.updateLock.Lock()
+	defer tmm.updateLock.Unlock()
+
+	tmm.lock.RLock()
+	schemaConfigs := tmm.schemaConfigs
+	tmm.lock.RUnlock()
+
+	return tmm.setSchemaConfigs(schemaConfigs)
+}
+
+// SetSchemaConfigs 替换要同步的库和表，并重新读取表结构
+func (tmm *TableMetaManager) SetSchemaConfigs(schemaConfigs []SchemaConfig) error {
+	tmm.updateLock.Lock()
+	defer tmm.updateLock.Unlock()
+
+	return tmm.setSchemaConfigs(schemaConfigs)
+}
+
+// setSchemaConfigs 实现 SetSchemaConfigs，调用时需持有updateLock
+func (tmm *TableMetaManager) setSchemaConfigs(schemaConfigs []SchemaConfig) error {
+	schemas, err := tmm.buildSchemas(schemaConfigs)
+	if err != nil {
+		return err
+	}
+
+	tmm.lock.Lock()
+	tmm.schemaConfigs = schemaConfigs
+	tmm.schemas = schemas
+	tmm.lock.Unlock()
+
+	return nil
+}
+
+// HandleDDL 在binlog中出现DDL时调用，重新读取受影响的表
+// defaultSchema 是QueryEvent.Schema，query 是QueryEvent.Query，executed 是包含该DDL的GTIDSet
+// 表名列表留空的库，新建的表会被加入，删除的表会被移除
+// 设置了SchemaHistory时，新的表结构会作为executed位置的版本记录下来；
+// 如果executed已经被记录过（从较早的位置重新同步），不会再读取表结构
+func (tmm *TableMetaManager) HandleDDL(defaultSchema, query string, executed mysql.GTIDSet) error {
+	refs := ParseDDLTables(defaultSchema, query)
+	if len(refs) == 0 || tmm.db == nil {
+		return nil
+	}
+
+	if tmm.history != nil && executed != nil && tmm.history.Recorded(executed) {
+		log.Infof("DDL已经记录在表结构历史中，跳过: %s\n", query)
+		return nil
+	}
+
+	tmm.updateLock.Lock()
+	defer tmm.updateLock.Unlock()
+
+	for _, ref := range refs {
+		sc, ok := tmm.schemaConfig(ref.Schema)
+		if !ok || !sc.includes(ref.Table) {
+			continue
+		}
+
+		table, err := tmm.readTable(ref.Schema, ref.Table)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("表结构变化，重新读取 %s.%s: %+v\n", ref.Schema, ref.Table, table)
+
+		if tmm.history != nil && executed != nil {
+			v := SchemaVersion{
+				Schema:     ref.Schema,
+				Table:      ref.Table,
+				GTIDSet:    executed.String(),
+				Columns:    table.Columns,
+				PrimaryKey: table.PrimaryKey,
+			}
+			if err = tmm.history.Append(v); err != nil {
+				return err
+			}
+		}
+
+		tmm.lock.Lock()
+		tmm.schemas = withTable(tmm.schemas, ref.Schema, table)
+		tmm.lock.Unlock()
+	}
+
+	return nil
+}
+
+func (tmm *TableMetaManager) schemaConfig(schemaName string) (SchemaConfig, bool) {
+	tmm.lock.RLock()
+	defer tmm.lock.RUnlock()
+
+	for _, sc := range tmm.schemaConfigs {
+		if sc.Name == schemaName {
+			return sc, true
+		}
+	}
+	return SchemaConfig{}, false
+}
+
+// withTable 返回替换了表定义后的schemas，不修改原来的schemas
+// table.Columns为空表示表已经被删除
+func withTable(schemas []Schema, schemaName string, table Table) []Schema {
+	result := make([]Schema, len(schemas))
+	copy(result, schemas)
+
+	for i, sc := range result {
+		if sc.Name != schemaName {
+			continue
+		}
+
+		tables := make([]Table, 0, len(sc.Tables)+1)
+		found := false
+		for _, tbl := range sc.Tables {
+			if tbl.Name == table.Name {
+				found = true
+				if len(table.Columns) == 0 {
+					continue
+				}
+				tbl = table
+			}
+			tables = append(tables, tbl)
+		}
+		if !found && len(table.Columns) > 0 {
+			tables = append(tables, table)
+		}
+
+		result[i].Tables = tables
+		return result
+	}
+
+	if len(table.Columns) > 0 {
+		result = append(result, Schema{Name: schemaName, Tables: []Table{table}})
+	}
+	return result
+}
+
+// SetSchemaHistory 设置记录表结构历史版本的SchemaHistory
+func (tmm *TableMetaManager) SetSchemaHistory(history *SchemaHistory) {
+	tmm.history = history
+}
+
+// BootstrapSchemaHistory 在表结构历史为空时，把当前所有表结构作为executed位置的版本记录下来
+func (tmm *TableMetaManager) BootstrapSchemaHistory(executed mysql.GTIDSet) error {
+	if tmm.history == nil || !tmm.history.Empty() {
+		return nil
+	}
+
+	log.Infof("记录表结构历史初始版本，GTIDSet: %s\n", executed)
+	return tmm.RecordSchemaHistory(executed)
+}
+
+// RecordSchemaHistory 把当前所有表结构作为executed位置的版本记录下来，用于重新读取表结构之后
+// 没有设置SchemaHistory或者executed为nil时不记录
+func (tmm *TableMetaManager) RecordSchemaHistory(executed mysql.GTIDSet) error {
+	if tmm.history == nil || executed == nil {
+		return nil
+	}
+
+	tmm.lock.RLock()
+	var versions []SchemaVersion
+	for _, sc := range tmm.schemas {
+		for _, tbl := range sc.Tables {
+			versions = append(versions, SchemaVersion{
+				Schema:     sc.Name,
+				Table:      tbl.Name,
+				GTIDSet:    executed.String(),
+				Columns:    tbl.Columns,
+				PrimaryKey: tbl.PrimaryKey,
+			})
+		}
+	}
+	tmm.lock.RUnlock()
+
+	return tmm.history.Append(versions...)
+}
+
+// QueryAt 查找binlog位置为executed时的表结构
+// 没有设置SchemaHistory或者历史中没有该位置的版本时，返回当前的表结构
+func (tmm *TableMetaManager) QueryAt(schemaName, tableName string, executed mysql.GTIDSet) (*Table, error) {
+	if tmm.history != nil && executed != nil {
+		if v, ok := tmm.history.Lookup(schemaName, tableName, executed); ok {
+			if len(v.Columns) == 0 {
+				return nil, ErrNotFound
+			}
+			return &Table{Name: v.Table, Columns: v.Columns, PrimaryKey: v.PrimaryKey}, nil
+		}
+	}
+
+	return tmm.Query(schemaName, tableName)
+}
+
+// At 返回binlog位置为executed时的TableQuerier
+func (tmm *TableMetaManager) At(executed mysql.GTIDSet) TableQuerier {
+	return tableMetaAt{tmm: tmm, executed: executed}
+}
+
+type tableMetaAt struct {
+	tmm      *TableMetaManager
+	executed mysql.GTIDSet
+}
+
+func (t tableMetaAt) Query(schemaName, tableName string) (*Table, error) {
+	return t.tmm.QueryAt(schemaName, tableName, t.executed)
+}
+
+func (tmm *TableMetaManager) buildSchemas(schemaConfigs []SchemaConfig) ([]Schema, error) {
+	if tmm.db == nil {
+		return nil, nil
+	}
+
 	var schemas []Schema
-	for _, schema := range tmm.schemaConfigs {
+	for _, schema := range schemaConfigs {
 		if len(schema.Tables) == 0 {
 			// 查询该库所有表
 			tbls, err := tmm.readAllTableNamesInSchema(schema.Name)
@@ -66,32 +317,11 @@ func (tmm *TableMetaManager) buildSchemas() ([]Schema, error) {
 
 		var tables []Table
 		for _, tableName := range schema.Tables {
-			rows, err := tmm.db.Query(q, schema.Name, tableName)
+			table, err := tmm.readTable(schema.Name, tableName)
 			if err != nil {
 				return nil, err
 			}
 
-			var columns []Column
-			for rows.Next() {
-				var ord int
-				var colName, isNullable, dataType string
-				if err = rows.Scan(&colName, &ord, &isNullable, &dataType); err != nil {
-					return nil, err
-				}
-
-				column := Column{
-					ColumnName:      colName,
-					OrdinalPosition: ord,
-					IsNullable:      isNullable,
-					DataType:        dataType,
-				}
-				columns = append(columns, column)
-			}
-
-			table := Table{}
-			table.Columns = columns
-			table.Name = tableName
-
 			tables = append(tables, table)
 		}
 
@@ -104,7 +334,71 @@ func (tmm *TableMetaManager) buildSchemas() ([]Schema, error) {
 	return schemas, nil
 }
 
-func (tmm TableMetaManager) readAllTableNamesInSchema(schemaName string) ([]string, error) {
+func (tmm *TableMetaManager) readTable(schemaName, tableName string) (Table, error) {
+	table := Table{Name: tableName}
+
+	var err error
+	if table.Columns, err = tmm.readColumns(schemaName, tableName); err != nil {
+		return table, err
+	}
+	if table.PrimaryKey, err = tmm.readPrimaryKey(schemaName, tableName); err != nil {
+		return table, err
+	}
+
+	return table, nil
+}
+
+func (tmm *TableMetaManager) readColumns(schemaName, tableName string) ([]Column, error) {
+	q := "SELECT COLUMN_NAME,ORDINAL_POSITION,IS_NULLABLE,DATA_TYPE,COLUMN_KEY FROM COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION ASC"
+	rows, err := tmm.db.Query(q, schemaName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []Column
+	for rows.Next() {
+		var ord int
+		var colName, isNullable, dataType, columnKey string
+		if err = rows.Scan(&colName, &ord, &isNullable, &dataType, &columnKey); err != nil {
+			return nil, err
+		}
+
+		column := Column{
+			ColumnName:      colName,
+			OrdinalPosition: ord,
+			IsNullable:      isNullable,
+			DataType:        dataType,
+			ColumnKey:       columnKey,
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+}
+
+// readPrimaryKey 按在主键中的顺序返回主键字段，没有主键时返回nil
+func (tmm *TableMetaManager) readPrimaryKey(schemaName, tableName string) ([]string, error) {
+	q := "SELECT COLUMN_NAME FROM STATISTICS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND INDEX_NAME = 'PRIMARY' ORDER BY SEQ_IN_INDEX ASC"
+	rows, err := tmm.db.Query(q, schemaName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+func (tmm *TableMetaManager) readAllTableNamesInSchema(schemaName string) ([]string, error) {
 	rows, err := tmm.db.Query("SELECT `TABLE_NAME` FROM `TABLES` WHERE `TABLE_SCHEMA` = ?", schemaName)
 	if err != nil {
 		return nil, err
@@ -123,7 +417,10 @@ func (tmm TableMetaManager) readAllTableNamesInSchema(schemaName string) ([]stri
 	return names, nil
 }
 
-func (tmm TableMetaManager) Dump(w io.Writer) {
+func (tmm *TableMetaManager) Dump(w io.Writer) {
+	tmm.lock.RLock()
+	defer tmm.lock.RUnlock()
+
 	if bs, err := json.Marshal(tmm.schemas); err != nil {
 		w.Write([]byte("dump err: " + err.Error()))
 	} else {
@@ -131,7 +428,10 @@ func (tmm TableMetaManager) Dump(w io.Writer) {
 	}
 }
 
-func (tmm TableMetaManager) AsStr() string {
+func (tmm *TableMetaManager) AsStr() string {
+	tmm.lock.RLock()
+	defer tmm.lock.RUnlock()
+
 	bs, err := json.Marshal(tmm.schemas)
 	if err != nil {
 		return ""
@@ -159,6 +459,49 @@ var colValueFormat = map[string]func(Column, interface{}) interface{}{
 
 		return v
 	},
+	"enum": func(c Column, v interface{}) interface{} {
+		// binlog中是从1开始的下标，0表示空字符串
+		if i, ok := v.(int64); ok && len(c.EnumValues) > 0 {
+			if i == 0 {
+				return ""
+			}
+			if i > 0 && int(i) <= len(c.EnumValues) {
+				return c.EnumValues[i-1]
+			}
+		}
+		return v
+	},
+	"set": func(c Column, v interface{}) interface{} {
+		// binlog中是位图
+		if i, ok := v.(int64); ok && len(c.SetValues) > 0 {
+			var values []string
+			for j, s := range c.SetValues {
+				if i&(1<<uint(j)) != 0 {
+					values = append(values, s)
+				}
+			}
+			return strings.Join(values, ",")
+		}
+		return v
+	},
+}
+
+// formatUnsigned 把binlog中按有符号解析的整数转成无符号
+func formatUnsigned(c Column, v interface{}) interface{} {
+	switch i := v.(type) {
+	case int8:
+		return uint8(i)
+	case int16:
+		return uint16(i)
+	case int32:
+		if c.DataType == "mediumint" {
+			return uint32(i) & 0xFFFFFF
+		}
+		return uint32(i)
+	case int64:
+		return uint64(i)
+	}
+	return v
 }
 
 // Column 表示mysql字段
@@ -167,6 +510,13 @@ type Column struct {
 	OrdinalPosition int    `gorm:"column:ORDINAL_POSITION"`
 	IsNullable      string `gorm:"column:IS_NULLABLE"`
 	DataType        string `gorm:"column:DATA_TYPE"`
+	// ColumnKey 是PRI、UNI、MUL或者空
+	ColumnKey string `gorm:"column:COLUMN_KEY" json:",omitempty"`
+
+	// 以下来自TableMapEvent的可选元数据，从information_schema读取时为空
+	Unsigned   bool     `json:",omitempty"`
+	EnumValues []string `json:",omitempty"`
+	SetValues  []string `json:",omitempty"`
 }
 
 // Format 把字段值处理成合适的类型
@@ -182,6 +532,9 @@ type Column struct {
 //
 // 添加更多的转换到`colValueFormat`
 func (c Column) Format(v interface{}) interface{} {
+	if c.Unsigned {
+		v = formatUnsigned(c, v)
+	}
 	if format, ok := colValueFormat[c.DataType]; ok {
 		return format(c, v)
 	}
@@ -197,6 +550,8 @@ func (Column) TableName() string {
 type Table struct {
 	Name    string
 	Columns []Column
+	// PrimaryKey 是按在主键中的顺序排列的主键字段，没有主键时为空
+	PrimaryKey []string `json:",omitempty"`
 }
 
 // Schema 表示库
@@ -0,0 +1,387 @@
+package mysql2nsq
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// TableMapEvent中可选元数据的类型，见mysql libbinlogevents/include/rows_event.h
+// mysql 8.0.1之后，binlog_row_metadata=FULL时会带上字段名等信息
+const (
+	tableMapSignedness               byte = 1
+	tableMapDefaultCharset           byte = 2
+	tableMapColumnCharset            byte = 3
+	tableMapColumnName               byte = 4
+	tableMapSetStrValue              byte = 5
+	tableMapEnumStrValue             byte = 6
+	tableMapGeometryType             byte = 7
+	tableMapSimplePrimaryKey         byte = 8
+	tableMapPrimaryKeyWithPrefix     byte = 9
+	tableMapEnumAndSetDefaultCharset byte = 10
+	tableMapEnumAndSetColumnCharset  byte = 11
+	tableMapColumnVisibility         byte = 12
+)
+
+const (
+	binlogEventHeaderSize      = 19
+	binlogChecksumSize         = 4
+	tableMapDefaultTableIDSize = 6
+	// binary字符集，字符类型字段是这个字符集时实际是二进制类型
+	binaryCharset = 63
+)
+
+var errTableMapTooShort = errors.New("table map event too short")
+
+// TableFromTableMapEvent 用TableMapEvent中的可选元数据构造表结构
+// checksum 表示事件末尾是否带有CRC32校验码，来自FormatDescriptionEvent.ChecksumAlgorithm
+// 没有字段名（binlog_row_metadata不是FULL）时返回nil
+func TableFromTableMapEvent(ev *replication.BinlogEvent, checksum bool) (*Table, error) {
+	e, ok := ev.Event.(*replication.TableMapEvent)
+	if !ok {
+		return nil, ErrInvalidEventType
+	}
+
+	data := ev.RawData
+	if len(data) < binlogEventHeaderSize {
+		return nil, errTableMapTooShort
+	}
+	data = data[binlogEventHeaderSize:]
+	if checksum {
+		if len(data) < binlogChecksumSize {
+			return nil, errTableMapTooShort
+		}
+		data = data[:len(data)-binlogChecksumSize]
+	}
+
+	optional, err := tableMapOptionalMetadata(data, int(e.ColumnCount))
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := decodeTableMapMetadata(optional, e)
+	if err != nil {
+		return nil, err
+	}
+	if meta.names == nil {
+		return nil, nil
+	}
+	if len(meta.names) != int(e.ColumnCount) {
+		return nil, fmt.Errorf("column name count %d not match column count %d", len(meta.names), e.ColumnCount)
+	}
+
+	table := &Table{Name: string(e.Table)}
+	enumIndex, setIndex, numericIndex, charIndex := 0, 0, 0, 0
+	for i := 0; i < int(e.ColumnCount); i++ {
+		typ := realColumnType(e, i)
+		column := Column{
+			ColumnName:      meta.names[i],
+			OrdinalPosition: i + 1,
+			IsNullable:      "NO",
+		}
+
+		if isBitSet(e.NullBitmap, i) {
+			column.IsNullable = "YES"
+		}
+
+		charset := -1
+		switch {
+		case isNumericType(typ):
+			column.Unsigned = numericIndex < len(meta.unsigned) && meta.unsigned[numericIndex]
+			numericIndex++
+		case typ == mysql.MYSQL_TYPE_ENUM:
+			if enumIndex < len(meta.enumValues) {
+				column.EnumValues = meta.enumValues[enumIndex]
+			}
+			enumIndex++
+		case typ == mysql.MYSQL_TYPE_SET:
+			if setIndex < len(meta.setValues) {
+				column.SetValues = meta.setValues[setIndex]
+			}
+			setIndex++
+		case isCharacterType(typ):
+			charset = meta.charset(charIndex)
+			charIndex++
+		}
+		column.DataType = dataTypeName(typ, charset)
+
+		table.Columns = append(table.Columns, column)
+	}
+
+	for _, index := range meta.primaryKey {
+		if index < len(table.Columns) {
+			table.Columns[index].ColumnKey = "PRI"
+			table.PrimaryKey = append(table.PrimaryKey, table.Columns[index].ColumnName)
+		}
+	}
+
+	return table, nil
+}
+
+// tableMapOptionalMetadata 跳过TableMapEvent中已经被go-mysql解析的部分，返回可选元数据
+func tableMapOptionalMetadata(data []byte, columnCount int) ([]byte, error) {
+	pos := tableMapDefaultTableIDSize + 2
+
+	// schema和table，各自以0结尾
+	for i := 0; i < 2; i++ {
+		if pos >= len(data) {
+			return nil, errTableMapTooShort
+		}
+		pos += 1 + int(data[pos]) + 1
+	}
+
+	if pos >= len(data) {
+		return nil, errTableMapTooShort
+	}
+	_, _, n := mysql.LengthEncodedInt(data[pos:])
+	pos += n + columnCount
+
+	if pos >= len(data) {
+		return nil, errTableMapTooShort
+	}
+	_, _, n, err := mysql.LengthEncodedString(data[pos:])
+	if err != nil {
+		return nil, err
+	}
+	pos += n + (columnCount+7)/8
+
+	if pos > len(data) {
+		return nil, errTableMapTooShort
+	}
+	return data[pos:], nil
+}
+
+type tableMapMetadata struct {
+	unsigned       []bool
+	defaultCharset int
+	charsets       map[int]int // 字符类型字段的下标 -> 字符集
+	columnCharsets []int
+	names          []string
+	enumValues     [][]string
+	setValues      [][]string
+	primaryKey     []int
+}
+
+func (m tableMapMetadata) charset(charIndex int) int {
+	if m.columnCharsets != nil {
+		if charIndex < len(m.columnCharsets) {
+			return m.columnCharsets[charIndex]
+		}
+		return -1
+	}
+	if c, ok := m.charsets[charIndex]; ok {
+		return c
+	}
+	return m.defaultCharset
+}
+
+func decodeTableMapMetadata(data []byte, e *replication.TableMapEvent) (tableMapMetadata, error) {
+	meta := tableMapMetadata{defaultCharset: -1}
+
+	for len(data) > 0 {
+		typ := data[0]
+		length, _, n := mysql.LengthEncodedInt(data[1:])
+		start := 1 + n
+		end := start + int(length)
+		if n == 0 || end > len(data) {
+			return meta, errTableMapTooShort
+		}
+		value := data[start:end]
+		data = data[end:]
+
+		var err error
+		switch typ {
+		case tableMapSignedness:
+			numericCount := 0
+			for i := 0; i < int(e.ColumnCount); i++ {
+				if isNumericType(realColumnType(e, i)) {
+					numericCount++
+				}
+			}
+			for i := 0; i < numericCount && i/8 < len(value); i++ {
+				meta.unsigned = append(meta.unsigned, value[i/8]&(1<<uint(7-i%8)) != 0)
+			}
+		case tableMapDefaultCharset:
+			var ints []int
+			if ints, err = decodeLengthEncodedInts(value); err == nil && len(ints) > 0 {
+				meta.defaultCharset = ints[0]
+				meta.charsets = make(map[int]int)
+				for i := 1; i+1 < len(ints); i += 2 {
+					meta.charsets[ints[i]] = ints[i+1]
+				}
+			}
+		case tableMapColumnCharset:
+			meta.columnCharsets, err = decodeLengthEncodedInts(value)
+		case tableMapColumnName:
+			meta.names, err = decodeLengthEncodedStrings(value)
+		case tableMapEnumStrValue:
+			meta.enumValues, err = decodeStrValues(value)
+		case tableMapSetStrValue:
+			meta.setValues, err = decodeStrValues(value)
+		case tableMapSimplePrimaryKey:
+			meta.primaryKey, err = decodeLengthEncodedInts(value)
+		case tableMapPrimaryKeyWithPrefix:
+			var ints []int
+			if ints, err = decodeLengthEncodedInts(value); err == nil {
+				for i := 0; i+1 < len(ints); i += 2 {
+					meta.primaryKey = append(meta.primaryKey, ints[i])
+				}
+			}
+		}
+		// 其他类型的元数据用不到，忽略
+
+		if err != nil {
+			return meta, err
+		}
+	}
+
+	return meta, nil
+}
+
+func decodeLengthEncodedInts(data []byte) ([]int, error) {
+	var ints []int
+	for len(data) > 0 {
+		v, _, n := mysql.LengthEncodedInt(data)
+		if n == 0 || n > len(data) {
+			return nil, errTableMapTooShort
+		}
+		ints = append(ints, int(v))
+		data = data[n:]
+	}
+	return ints, nil
+}
+
+func decodeLengthEncodedStrings(data []byte) ([]string, error) {
+	strs := []string{}
+	for len(data) > 0 {
+		s, _, n, err := mysql.LengthEncodedString(data)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, string(s))
+		data = data[n:]
+	}
+	return strs, nil
+}
+
+// decodeStrValues 解析ENUM/SET的可选值，每个字段先是值的个数，然后是每个值
+func decodeStrValues(data []byte) ([][]string, error) {
+	var values [][]string
+	for len(data) > 0 {
+		count, _, n := mysql.LengthEncodedInt(data)
+		if n == 0 || n > len(data) {
+			return nil, errTableMapTooShort
+		}
+		data = data[n:]
+
+		strs := make([]string, 0, count)
+		for i := 0; i < int(count); i++ {
+			s, _, n, err := mysql.LengthEncodedString(data)
+			if err != nil {
+				return nil, err
+			}
+			strs = append(strs, string(s))
+			data = data[n:]
+		}
+		values = append(values, strs)
+	}
+	return values, nil
+}
+
+// realColumnType 返回字段的实际类型，ENUM和SET在TableMapEvent中是MYSQL_TYPE_STRING，实际类型在meta的高位
+func realColumnType(e *replication.TableMapEvent, i int) byte {
+	typ := e.ColumnType[i]
+	if typ == mysql.MYSQL_TYPE_STRING && i < len(e.ColumnMeta) {
+		if real := byte(e.ColumnMeta[i] >> 8); real == mysql.MYSQL_TYPE_ENUM || real == mysql.MYSQL_TYPE_SET {
+			return real
+		}
+	}
+	return typ
+}
+
+func isNumericType(typ byte) bool {
+	switch typ {
+	case mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONG,
+		mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_FLOAT, mysql.MYSQL_TYPE_DOUBLE:
+		return true
+	}
+	return false
+}
+
+func isCharacterType(typ byte) bool {
+	switch typ {
+	case mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_BLOB:
+		return true
+	}
+	return false
+}
+
+// dataTypeName 返回和information_schema.COLUMNS.DATA_TYPE一致的类型名
+// charset 是字符类型字段的字符集，binary表示二进制类型
+func dataTypeName(typ byte, charset int) string {
+	binary := charset == binaryCharset
+
+	switch typ {
+	case mysql.MYSQL_TYPE_TINY:
+		return "tinyint"
+	case mysql.MYSQL_TYPE_SHORT:
+		return "smallint"
+	case mysql.MYSQL_TYPE_INT24:
+		return "mediumint"
+	case mysql.MYSQL_TYPE_LONG:
+		return "int"
+	case mysql.MYSQL_TYPE_LONGLONG:
+		return "bigint"
+	case mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_DECIMAL:
+		return "decimal"
+	case mysql.MYSQL_TYPE_FLOAT:
+		return "float"
+	case mysql.MYSQL_TYPE_DOUBLE:
+		return "double"
+	case mysql.MYSQL_TYPE_BIT:
+		return "bit"
+	case mysql.MYSQL_TYPE_TIMESTAMP, mysql.MYSQL_TYPE_TIMESTAMP2:
+		return "timestamp"
+	case mysql.MYSQL_TYPE_DATETIME, mysql.MYSQL_TYPE_DATETIME2:
+		return "datetime"
+	case mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_NEWDATE:
+		return "date"
+	case mysql.MYSQL_TYPE_TIME, mysql.MYSQL_TYPE_TIME2:
+		return "time"
+	case mysql.MYSQL_TYPE_YEAR:
+		return "year"
+	case mysql.MYSQL_TYPE_ENUM:
+		return "enum"
+	case mysql.MYSQL_TYPE_SET:
+		return "set"
+	case mysql.MYSQL_TYPE_JSON:
+		return "json"
+	case mysql.MYSQL_TYPE_GEOMETRY:
+		return "geometry"
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING:
+		if binary {
+			return "varbinary"
+		}
+		return "varchar"
+	case mysql.MYSQL_TYPE_STRING:
+		if binary {
+			return "binary"
+		}
+		return "char"
+	case mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_TINY_BLOB, mysql.MYSQL_TYPE_MEDIUM_BLOB, mysql.MYSQL_TYPE_LONG_BLOB:
+		if binary {
+			return "blob"
+		}
+		return "text"
+	}
+	return ""
+}
+
+func isBitSet(bitmap []byte, i int) bool {
+	if i>>3 >= len(bitmap) {
+		return false
+	}
+	return bitmap[i>>3]&(1<<(uint(i)&7)) > 0
+}
@@ -0,0 +1,113 @@
+package mysql2nsq
+
+import (
+	"context"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/stretchr/testify/assert"
+)
+
+func lenencStr(s string) []byte {
+	return append(mysql.PutLengthEncodedInt(uint64(len(s))), s...)
+}
+
+func tlv(typ byte, value []byte) []byte {
+	return append(append([]byte{typ}, mysql.PutLengthEncodedInt(uint64(len(value)))...), value...)
+}
+
+// tableMapEvent 构造db1.user表的TableMapEvent：
+// id bigint unsigned, name varchar(100), status enum('a','b'), created_at datetime NULL
+func tableMapEvent(optional []byte) *replication.BinlogEvent {
+	types := []byte{mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_DATETIME2}
+	meta := []byte{0x2c, 0x01, mysql.MYSQL_TYPE_ENUM, 0x01, 0x00}
+	nullBitmap := []byte{0x08}
+
+	raw := make([]byte, binlogEventHeaderSize)
+	raw = append(raw, 1, 0, 0, 0, 0, 0) // table id
+	raw = append(raw, 0, 0)             // flags
+	raw = append(raw, 3)
+	raw = append(raw, "db1"...)
+	raw = append(raw, 0, 4)
+	raw = append(raw, "user"...)
+	raw = append(raw, 0, byte(len(types)))
+	raw = append(raw, types...)
+	raw = append(raw, lenencStr(string(meta))...)
+	raw = append(raw, nullBitmap...)
+	raw = append(raw, optional...)
+	raw = append(raw, 0xde, 0xad, 0xbe, 0xef) // checksum
+
+	return &replication.BinlogEvent{
+		RawData: raw,
+		Header:  &replication.EventHeader{EventType: replication.TABLE_MAP_EVENT},
+		Event: &replication.TableMapEvent{
+			TableID:     1,
+			Schema:      []byte("db1"),
+			Table:       []byte("user"),
+			ColumnCount: uint64(len(types)),
+			ColumnType:  types,
+			ColumnMeta:  []uint16{0, 300, uint16(mysql.MYSQL_TYPE_ENUM)<<8 | 1, 0},
+			NullBitmap:  nullBitmap,
+		},
+	}
+}
+
+func TestTableFromTableMapEvent(t *testing.T) {
+	var names []byte
+	for _, name := range []string{"id", "name", "status", "created_at"} {
+		names = append(names, lenencStr(name)...)
+	}
+
+	var optional []byte
+	optional = append(optional, tlv(tableMapSignedness, []byte{0x80})...)
+	optional = append(optional, tlv(tableMapDefaultCharset, []byte{45})...)
+	optional = append(optional, tlv(tableMapColumnName, names)...)
+	optional = append(optional, tlv(tableMapEnumStrValue, append([]byte{2}, append(lenencStr("a"), lenencStr("b")...)...))...)
+	optional = append(optional, tlv(tableMapSimplePrimaryKey, []byte{0})...)
+
+	table, err := TableFromTableMapEvent(tableMapEvent(optional), true)
+	assert.Nil(t, err)
+	assert.Equal(t, &Table{
+		Name: "user",
+		Columns: []Column{
+			{ColumnName: "id", OrdinalPosition: 1, IsNullable: "NO", DataType: "bigint", ColumnKey: "PRI", Unsigned: true},
+			{ColumnName: "name", OrdinalPosition: 2, IsNullable: "NO", DataType: "varchar"},
+			{ColumnName: "status", OrdinalPosition: 3, IsNullable: "NO", DataType: "enum", EnumValues: []string{"a", "b"}},
+			{ColumnName: "created_at", OrdinalPosition: 4, IsNullable: "YES", DataType: "datetime"},
+		},
+		PrimaryKey: []string{"id"},
+	}, table)
+
+	assert.Equal(t, uint64(18446744073709551615), table.Columns[0].Format(int64(-1)))
+	assert.Equal(t, "b", table.Columns[2].Format(int64(2)))
+	assert.Equal(t, "", table.Columns[2].Format(int64(0)))
+}
+
+func TestTableFromTableMapEventWithoutMetadata(t *testing.T) {
+	table, err := TableFromTableMapEvent(tableMapEvent(nil), true)
+	assert.Nil(t, err)
+	assert.Nil(t, table)
+}
+
+func TestRunnerPreferTableMapMetadata(t *testing.T) {
+	var names []byte
+	for _, name := range []string{"uid", "nickname", "status", "created_at"} {
+		names = append(names, lenencStr(name)...)
+	}
+
+	sink := &memSink{}
+	tmm := newTestTableMetaManager()
+	r := NewRunner(Config{MessageFormat: FormatChanges}, tmm, &memStorage{}, sink)
+
+	assert.Nil(t, r.handleEvent(context.Background(), &replication.BinlogEvent{
+		Header: &replication.EventHeader{EventType: replication.FORMAT_DESCRIPTION_EVENT},
+		Event:  &replication.FormatDescriptionEvent{ChecksumAlgorithm: replication.BINLOG_CHECKSUM_ALG_CRC32},
+	}))
+	assert.Nil(t, r.handleEvent(context.Background(), tableMapEvent(tlv(tableMapColumnName, names))))
+	assert.Nil(t, r.handleEvent(context.Background(), rowsEvent("db1", "user", []interface{}{1, "hiwjd", int64(1), nil})))
+
+	dc := &DataChanged{}
+	assert.Nil(t, dc.Decode(sink.msgs[0].Body))
+	assert.Equal(t, map[string]interface{}{"uid": float64(1), "nickname": "hiwjd", "status": float64(1), "created_at": nil}, dc.Changes[0].After)
+}
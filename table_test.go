@@ -1,16 +1,16 @@
 package mysql2nsq
 
 import (
+	"database/sql"
 	"testing"
 
-	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestNewTableMetaManager(t *testing.T) {
 	t.Skip("依赖mysql特定表information_schema")
-	db, err := gorm.Open("mysql", "root:@/information_schema?charset=utf8&parseTime=True&loc=Local")
+	db, err := sql.Open("mysql", "root:@/information_schema?charset=utf8&parseTime=True&loc=Local")
 	assert.Nil(t, err)
 	defer db.Close()
 
@@ -25,7 +25,7 @@ func TestNewTableMetaManager(t *testing.T) {
 			Table{
 				Name: "picking_batch",
 				Columns: []Column{
-					Column{ColumnName: "id", OrdinalPosition: 1, IsNullable: "NO", DataType: "int"},
+					Column{ColumnName: "id", OrdinalPosition: 1, IsNullable: "NO", DataType: "int", ColumnKey: "PRI"},
 					Column{ColumnName: "batch_no", OrdinalPosition: 2, IsNullable: "NO", DataType: "varchar"},
 					Column{ColumnName: "shop_id", OrdinalPosition: 3, IsNullable: "NO", DataType: "int"},
 					Column{ColumnName: "operator_name", OrdinalPosition: 4, IsNullable: "NO", DataType: "varchar"},
@@ -34,11 +34,12 @@ func TestNewTableMetaManager(t *testing.T) {
 					Column{ColumnName: "updated_at", OrdinalPosition: 7, IsNullable: "YES", DataType: "datetime"},
 					Column{ColumnName: "deleted_at", OrdinalPosition: 8, IsNullable: "YES", DataType: "datetime"},
 				},
+				PrimaryKey: []string{"id"},
 			},
 			Table{
 				Name: "picking_batch_item",
 				Columns: []Column{
-					Column{ColumnName: "id", OrdinalPosition: 1, IsNullable: "NO", DataType: "int"},
+					Column{ColumnName: "id", OrdinalPosition: 1, IsNullable: "NO", DataType: "int", ColumnKey: "PRI"},
 					Column{ColumnName: "batch_no", OrdinalPosition: 2, IsNullable: "NO", DataType: "varchar"},
 					Column{ColumnName: "shop_id", OrdinalPosition: 3, IsNullable: "NO", DataType: "int"},
 					Column{ColumnName: "code", OrdinalPosition: 4, IsNullable: "NO", DataType: "varchar"},
@@ -49,6 +50,7 @@ func TestNewTableMetaManager(t *testing.T) {
 					Column{ColumnName: "updated_at", OrdinalPosition: 9, IsNullable: "YES", DataType: "datetime"},
 					Column{ColumnName: "deleted_at", OrdinalPosition: 10, IsNullable: "YES", DataType: "datetime"},
 				},
+				PrimaryKey: []string{"id"},
 			},
 		},
 	}
@@ -61,7 +63,7 @@ func TestNewTableMetaManager(t *testing.T) {
 
 func TestReadAllTableNamesInSchema(t *testing.T) {
 	t.Skip("依赖mysql特定表information_schema")
-	db, err := gorm.Open("mysql", "mysql2nsq:mysql2nsq@(127.0.0.1:3309)/information_schema?charset=utf8&parseTime=True&loc=Local")
+	db, err := sql.Open("mysql", "mysql2nsq:mysql2nsq@(127.0.0.1:3309)/information_schema?charset=utf8&parseTime=True&loc=Local")
 	assert.Nil(t, err)
 	defer db.Close()
 
@@ -76,3 +78,49 @@ func TestReadAllTableNamesInSchema(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, []string{"operator", "order", "order_item", "picking_batch", "picking_batch_item", "product", "shop", "shop_operator", "sms_queue", "sms_scene", "user"}, tableNames)
 }
+
+func TestWithTable(t *testing.T) {
+	user := Table{Name: "user", Columns: []Column{{ColumnName: "id", OrdinalPosition: 1}}}
+	schemas := []Schema{{Name: "db1", Tables: []Table{user}}}
+
+	// 新增字段
+	user2 := Table{Name: "user", Columns: []Column{{ColumnName: "id", OrdinalPosition: 1}, {ColumnName: "age", OrdinalPosition: 2}}}
+	result := withTable(schemas, "db1", user2)
+	assert.Equal(t, []Schema{{Name: "db1", Tables: []Table{user2}}}, result)
+	// 原来的不受影响
+	assert.Equal(t, []Schema{{Name: "db1", Tables: []Table{user}}}, schemas)
+
+	// 新建表
+	order := Table{Name: "order", Columns: []Column{{ColumnName: "id", OrdinalPosition: 1}}}
+	result = withTable(result, "db1", order)
+	assert.Equal(t, []Schema{{Name: "db1", Tables: []Table{user2, order}}}, result)
+
+	// 删除表
+	result = withTable(result, "db1", Table{Name: "user"})
+	assert.Equal(t, []Schema{{Name: "db1", Tables: []Table{order}}}, result)
+
+	// 还没有表的库
+	result = withTable(result, "db2", user)
+	assert.Equal(t, []Schema{{Name: "db1", Tables: []Table{order}}, {Name: "db2", Tables: []Table{user}}}, result)
+}
+
+func TestConcurrentQueryAndReplace(t *testing.T) {
+	tmm := newTestTableMetaManager()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			tmm.lock.Lock()
+			tmm.schemas = withTable(tmm.schemas, "db1", Table{Name: "user", Columns: []Column{{ColumnName: "id"}}})
+			tmm.lock.Unlock()
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		tbl, err := tmm.Query("db1", "user")
+		assert.Nil(t, err)
+		assert.NotEmpty(t, tbl.Columns)
+	}
+	<-done
+}